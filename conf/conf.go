@@ -1,25 +1,357 @@
 package conf
 
 import (
+	"flag"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uswitch/kube-sqs-autoscaler/schedule"
+	"github.com/uswitch/kube-sqs-autoscaler/steps"
+)
+
+// Scaling modes, the names of the policies built in to package scale
+const (
+	// StepScaling adds or removes replicas with the scale up/down operator and
+	// amount whenever the queue crosses the scale up/down thresholds.
+	StepScaling = "step"
+	// TargetTracking sets the replicas directly so each one has at most
+	// TargetMessagesPerPod messages queued.
+	TargetTracking = "target-tracking"
+	// Throughput sets the replicas to those needed to work through the backlog
+	// within TargetDrainTime, at the rate each replica processes messages.
+	Throughput = "throughput"
+	// StepTableScaling changes the replicas as set for the band of backlog
+	// sizes the queue is in, in ScaleUpSteps or ScaleDownSteps.
+	StepTableScaling = "step-table"
+)
+
+// Where the throughput of the replicas is measured
+const (
+	CloudWatchThroughput = "cloudwatch"
+	BacklogThroughput    = "backlog"
+)
+
+// Ways of combining the backlogs of several queues
+const (
+	SumQueues = "sum"
+	MaxQueues = "max"
 )
 
 type MyConfType struct {
 	PollInterval             time.Duration
 	ScaleDownCoolPeriod      time.Duration
 	ScaleUpCoolPeriod        time.Duration
+	ScaleDownStabilization   time.Duration
+	ScaleUpStabilization     time.Duration
 	ScaleUpMessages          int
+	ScaleUpAge               time.Duration
+	RateWindow               time.Duration
+	RateLookahead            time.Duration
+	RateMinGrowth            float64
 	ScaleDownMessages        int
 	MaxPods                  int
 	MinPods                  int
+	ScaleToZeroIdle          time.Duration
+	ActivationReplicas       int
+	Schedule                 string
+	ScheduleTimezone         string
 	AwsRegion                string
 	ScaleUpAmount            float64
 	ScaleDownAmount          float64
 	ScaleUpOperator          string
 	ScaleDownOperator        string
+	ScaleUpSteps             string
+	ScaleDownSteps           string
+	ScalingMode              string
+	TargetMessagesPerPod     int
+	TargetDrainTime          time.Duration
+	PodThroughput            float64
+	ThroughputSource         string
+	Source                   string
 	SqsQueueUrl              string
+	SqsQueueWeights          string
+	SqsQueueAggregation      string
+	VisibleMessagesWeight    float64
+	InFlightMessagesWeight   float64
+	DelayedMessagesWeight    float64
 	KubernetesDeploymentName string
+	KubernetesKind           string
 	KubernetesNamespace      string
+	Kubeconfig               string
+	KubernetesContext        string
+	StateConfigMap           string
 	ConfigFile               string
+	ConfigCheckPeriod        time.Duration
 	Active                   bool
+	DryRun                   bool
+}
+
+// Defaults returns the configuration used for any value not set explicitly.
+func Defaults() MyConfType {
+	return MyConfType{
+		PollInterval:          30 * time.Second,
+		ScaleDownCoolPeriod:   30 * time.Second,
+		ScaleUpCoolPeriod:     120 * time.Second,
+		ScaleUpMessages:       1000,
+		ScaleDownMessages:     0,
+		RateWindow:            5 * time.Minute,
+		RateMinGrowth:         1,
+		ScaleUpAmount:         1,
+		ScaleDownAmount:       1,
+		ScaleUpOperator:       "+",
+		ScaleDownOperator:     "-",
+		ScalingMode:           StepScaling,
+		TargetMessagesPerPod:  100,
+		TargetDrainTime:       5 * time.Minute,
+		ThroughputSource:      CloudWatchThroughput,
+		Source:                "sqs",
+		SqsQueueAggregation:   SumQueues,
+		VisibleMessagesWeight: 1,
+		MaxPods:               5,
+		MinPods:               1,
+		ActivationReplicas:    1,
+		KubernetesNamespace:   "default",
+		Active:                true,
+	}
+}
+
+// RegisterFlags defines the per-target flags on fs, using the current values in
+// myConf as the defaults.
+func RegisterFlags(fs *flag.FlagSet, myConf *MyConfType) {
+	fs.DurationVar(&myConf.PollInterval, "poll-period", myConf.PollInterval, "The interval in seconds for checking if scaling is required")
+	fs.DurationVar(&myConf.ScaleDownCoolPeriod, "scale-down-cool-off", myConf.ScaleDownCoolPeriod, "The cool off period for scaling down")
+	fs.DurationVar(&myConf.ScaleUpCoolPeriod, "scale-up-cool-off", myConf.ScaleUpCoolPeriod, "The cool off period for scaling up")
+	fs.DurationVar(&myConf.ScaleDownStabilization, "scale-down-stabilization", myConf.ScaleDownStabilization, "Only scale down as far as the highest number of replicas decided on in this long, so a noisy queue does not undo a scale up. 0 disables it")
+	fs.DurationVar(&myConf.ScaleUpStabilization, "scale-up-stabilization", myConf.ScaleUpStabilization, "Only scale up as far as the lowest number of replicas decided on in this long. 0 disables it")
+	fs.IntVar(&myConf.ScaleUpMessages, "scale-up-messages", myConf.ScaleUpMessages, "Number of sqs messages queued up required for scaling up")
+	fs.DurationVar(&myConf.ScaleUpAge, "scale-up-age", myConf.ScaleUpAge, "Scale up when the oldest message in the queue is at least this old, even if there are fewer than scale-up-messages queued. Read from CloudWatch; 0 disables it")
+	fs.DurationVar(&myConf.RateWindow, "rate-window", myConf.RateWindow, "How far back backlog readings are kept to work out how fast the backlog is changing, used with rate-lookahead and throughput-source=backlog")
+	fs.DurationVar(&myConf.RateLookahead, "rate-lookahead", myConf.RateLookahead, "Scale up when the backlog, growing at its current rate, would reach the scale up threshold within this long, and hold back scale downs while the backlog is growing. 0 disables it")
+	fs.Float64Var(&myConf.RateMinGrowth, "rate-min-growth", myConf.RateMinGrowth, "Least growth of the backlog, in messages per second, counted as growing with rate-lookahead set, so noise in the readings neither scales up nor holds back scale downs")
+	fs.IntVar(&myConf.ScaleDownMessages, "scale-down-messages", myConf.ScaleDownMessages, "Number of messages required to scale down")
+	fs.Float64Var(&myConf.ScaleUpAmount, "scale-up-amount", myConf.ScaleUpAmount, "The number used to scale up the replicas, used with scale-up-operator, e.g. + 3 or * 2")
+	fs.Float64Var(&myConf.ScaleDownAmount, "scale-down-amount", myConf.ScaleDownAmount, "The number used to scale down the replicas, used with scale-down-operator, e.g. - 3 or / 2")
+	fs.StringVar(&myConf.ScaleUpOperator, "scale-up-operator", myConf.ScaleUpOperator, "The operator used to scale up the replicas, used with scale-up-amount, e.g. + 3 or * 2")
+	fs.StringVar(&myConf.ScaleDownOperator, "scale-down-operator", myConf.ScaleDownOperator, "The operator used to scale down the replicas, used with scale-up-amount, e.g. - 3 or / 2")
+	fs.StringVar(&myConf.ScaleUpSteps, "scale-up-steps", myConf.ScaleUpSteps, "Bands of backlog sizes and how to scale up within each, separated by semicolons, used with scaling-mode=step-table, e.g. \"1000-10000 +1; 10000-50000 +5; 50000- =max\". A band includes its lower bound but not its upper bound")
+	fs.StringVar(&myConf.ScaleDownSteps, "scale-down-steps", myConf.ScaleDownSteps, "Bands of backlog sizes and how to scale down within each, separated by semicolons, used with scaling-mode=step-table, e.g. \"0-10 =min; 10-100 -1\"")
+
+	fs.StringVar(&myConf.ScalingMode, "scaling-mode", myConf.ScalingMode, "How the number of replicas is decided: step, to add or remove replicas with the scale operators when the queue crosses a threshold, step-table, to change them as set in scale-up-steps and scale-down-steps for the band the queue is in, target-tracking, to keep target-messages-per-pod messages queued per replica, or throughput, to work through the backlog within target-drain-time")
+	fs.IntVar(&myConf.TargetMessagesPerPod, "target-messages-per-pod", myConf.TargetMessagesPerPod, "The number of queued messages per replica to aim for, used with scaling-mode=target-tracking")
+	fs.DurationVar(&myConf.TargetDrainTime, "target-drain-time", myConf.TargetDrainTime, "How soon the backlog should be worked through, used with scaling-mode=throughput")
+	fs.Float64Var(&myConf.PodThroughput, "pod-throughput", myConf.PodThroughput, "Messages per second each replica works through, used with scaling-mode=throughput. 0 estimates it with throughput-source")
+	fs.StringVar(&myConf.ThroughputSource, "throughput-source", myConf.ThroughputSource, "How the messages worked through per second are measured to estimate pod-throughput: cloudwatch, from the NumberOfMessagesDeleted metric, or backlog, from how fast the backlog drains")
+
+	fs.IntVar(&myConf.MaxPods, "max-pods", myConf.MaxPods, "Max pods that kube-sqs-autoscaler can scale")
+	fs.IntVar(&myConf.MinPods, "min-pods", myConf.MinPods, "Min pods that kube-sqs-autoscaler can scale")
+	fs.DurationVar(&myConf.ScaleToZeroIdle, "scale-to-zero-idle", myConf.ScaleToZeroIdle, "Scale to zero replicas, below min-pods, once the queue has had no messages at all, including in flight and delayed ones, for this long. 0 disables it")
+	fs.IntVar(&myConf.ActivationReplicas, "activation-replicas", myConf.ActivationReplicas, "Replicas to scale a target at zero straight up to when a message arrives, used with scale-to-zero-idle")
+	fs.StringVar(&myConf.Schedule, "schedule", myConf.Schedule, "Windows of the week that override min-pods and max-pods, separated by semicolons, e.g. \"Mon-Fri 08:00-18:00 min=3 max=20; * 01:45-04:00 min=10 prescale=15\". prescale scales up to that many replicas as the window starts")
+	fs.StringVar(&myConf.ScheduleTimezone, "schedule-timezone", myConf.ScheduleTimezone, "The time zone of the schedule windows, e.g. Europe/London. UTC if unset")
+	fs.StringVar(&myConf.AwsRegion, "aws-region", myConf.AwsRegion, "Your AWS region")
+
+	fs.StringVar(&myConf.Source, "source", myConf.Source, "Where to read the backlog to scale on from")
+	fs.StringVar(&myConf.SqsQueueUrl, "sqs-queue-url", myConf.SqsQueueUrl, "The sqs queue url. Several queues can be given separated by spaces, and their backlogs are combined with sqs-queue-aggregation")
+	fs.StringVar(&myConf.SqsQueueWeights, "sqs-queue-weights", myConf.SqsQueueWeights, "Space separated weights to multiply the backlog of each queue in sqs-queue-url by, in the same order. Every queue has a weight of 1 if not set")
+	fs.StringVar(&myConf.SqsQueueAggregation, "sqs-queue-aggregation", myConf.SqsQueueAggregation, "How the backlogs of several queues are combined: sum, or max to scale on the largest one")
+	fs.Float64Var(&myConf.VisibleMessagesWeight, "visible-messages-weight", myConf.VisibleMessagesWeight, "How much each visible message, waiting to be received, counts towards the queue size used for scaling")
+	fs.Float64Var(&myConf.InFlightMessagesWeight, "in-flight-messages-weight", myConf.InFlightMessagesWeight, "How much each in flight message, received but not yet deleted, counts towards the queue size used for scaling")
+	fs.Float64Var(&myConf.DelayedMessagesWeight, "delayed-messages-weight", myConf.DelayedMessagesWeight, "How much each delayed message, not yet available to be received, counts towards the queue size used for scaling")
+	fs.StringVar(&myConf.KubernetesDeploymentName, "kubernetes-deployment", myConf.KubernetesDeploymentName, "Kubernetes Deployment to scale. This field is required")
+	fs.StringVar(&myConf.KubernetesKind, "kubernetes-kind", myConf.KubernetesKind, "The kind of object named by kubernetes-deployment: Deployment, ReplicaSet, StatefulSet, or group/version/resource for any object with a scale subresource, e.g. argoproj.io/v1alpha1/rollouts. Empty means Deployment")
+	fs.StringVar(&myConf.KubernetesNamespace, "kubernetes-namespace", myConf.KubernetesNamespace, "The namespace your deployment is running in")
+	fs.StringVar(&myConf.Kubeconfig, "kubeconfig", myConf.Kubeconfig, "Path to a kubeconfig file to run outside the cluster. If unset, KUBECONFIG and ~/.kube/config are tried before the in-cluster config")
+	fs.StringVar(&myConf.StateConfigMap, "state-configmap", myConf.StateConfigMap, "Name of a ConfigMap in kubernetes-namespace to save the cool off state and last decision in, so they survive restarts and leader changes. Empty keeps them in memory only")
+	fs.StringVar(&myConf.KubernetesContext, "context", myConf.KubernetesContext, "The kubeconfig context to use instead of its current context")
+
+	fs.BoolVar(&myConf.DryRun, "dry-run", myConf.DryRun, "Work out and log every scale, with its events and metrics, but never change the replicas")
+	fs.BoolVar(&myConf.Active, "active", myConf.Active, "true/false - whether autoscaling is active for this deployment. Containers with active=false will terminate with success status")
+}
+
+// Set changes a single setting, using the same name and parsing as its
+// command line flag.
+func (c *MyConfType) Set(name, value string) error {
+	fs := flag.NewFlagSet("conf", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	RegisterFlags(fs, c)
+
+	if fs.Lookup(name) == nil {
+		return errors.Errorf("unknown setting %q", name)
+	}
+	if err := fs.Set(name, value); err != nil {
+		return errors.Errorf("invalid value %q for %v: %v", value, name, err)
+	}
+	return nil
+}
+
+// ParseTarget builds the configuration for one -target flag. The value is a
+// comma separated list of flag=value pairs, e.g.
+// "kubernetes-deployment=worker,sqs-queue-url=https://...,max-pods=10", and any
+// setting it does not mention keeps the value from defaults. A comma inside a
+// value is written as \, and a backslash as \\, e.g. "schedule=Mon-Fri\,Sun 2".
+func ParseTarget(defaults MyConfType, spec string) (MyConfType, error) {
+	myConf := defaults
+
+	pairs, err := splitTarget(spec)
+	if err != nil {
+		return myConf, errors.Wrapf(err, "invalid target %q", spec)
+	}
+	for _, pair := range pairs {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return myConf, errors.Errorf("invalid target %q: %q is not a flag=value pair", spec, pair)
+		}
+		if err := myConf.Set(strings.TrimPrefix(kv[0], "-"), kv[1]); err != nil {
+			return myConf, errors.Wrapf(err, "invalid target %q", spec)
+		}
+	}
+	return myConf, nil
+}
+
+// splitTarget splits spec on the commas not escaped with a backslash, and
+// unescapes \, and \\ in the parts.
+func splitTarget(spec string) ([]string, error) {
+	var pairs []string
+	var pair []rune
+	escaped := false
+	for _, r := range spec {
+		switch {
+		case escaped:
+			if r != ',' && r != '\\' {
+				return nil, errors.Errorf("unknown escape \\%c, only \\, and \\\\ are allowed", r)
+			}
+			pair = append(pair, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ',':
+			pairs = append(pairs, string(pair))
+			pair = pair[:0]
+		default:
+			pair = append(pair, r)
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing \\")
+	}
+	return append(pairs, string(pair)), nil
+}
+
+// QueueUrls returns the queues listed in SqsQueueUrl.
+func (c MyConfType) QueueUrls() []string {
+	return strings.Fields(c.SqsQueueUrl)
+}
+
+// QueueWeights returns the weight of each queue in SqsQueueUrl.
+func (c MyConfType) QueueWeights() ([]float64, error) {
+	urls := c.QueueUrls()
+	weights := make([]float64, len(urls))
+
+	fields := strings.Fields(c.SqsQueueWeights)
+	if len(fields) == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		return weights, nil
+	}
+	if len(fields) != len(urls) {
+		return nil, errors.Errorf("sqs-queue-weights has %v weights for %v queues", len(fields), len(urls))
+	}
+	for i, field := range fields {
+		weight, err := strconv.ParseFloat(field, 64)
+		if err != nil || weight < 0 {
+			return nil, errors.Errorf("sqs-queue-weights %q is not a number of at least 0", field)
+		}
+		weights[i] = weight
+	}
+	return weights, nil
+}
+
+// ScheduleWindows returns the parsed Schedule.
+func (c MyConfType) ScheduleWindows() (schedule.Schedule, error) {
+	return schedule.Parse(c.Schedule, c.ScheduleTimezone)
+}
+
+// StepTables returns the parsed ScaleUpSteps and ScaleDownSteps, which must
+// not overlap each other.
+func (c MyConfType) StepTables() (up steps.Table, down steps.Table, err error) {
+	if up, err = steps.Parse(c.ScaleUpSteps); err != nil {
+		return up, down, errors.Wrap(err, "Invalid scale-up-steps")
+	}
+	if down, err = steps.Parse(c.ScaleDownSteps); err != nil {
+		return up, down, errors.Wrap(err, "Invalid scale-down-steps")
+	}
+	if up.Overlaps(down) {
+		return up, down, errors.New("scale-up-steps and scale-down-steps overlap")
+	}
+	return up, down, nil
+}
+
+// Validate checks that the configuration describes a target that can be scaled.
+// The settings of the scaling mode are checked by its policy, see
+// scale.NewPolicy.
+func (c MyConfType) Validate() error {
+	if c.KubernetesDeploymentName == "" {
+		return errors.New("kubernetes-deployment name not set")
+	}
+	if c.Source == "sqs" {
+		if len(c.QueueUrls()) == 0 {
+			return errors.New("sqs-queue-url name not set")
+		}
+		if _, err := c.QueueWeights(); err != nil {
+			return err
+		}
+		if c.SqsQueueAggregation != SumQueues && c.SqsQueueAggregation != MaxQueues {
+			return errors.Errorf("sqs-queue-aggregation %v not in the valid set of %v, %v", c.SqsQueueAggregation, SumQueues, MaxQueues)
+		}
+	}
+	windows, err := c.ScheduleWindows()
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.StepTables(); err != nil {
+		return err
+	}
+	for _, w := range windows.Windows {
+		if min, max := w.Limits(c.MinPods, c.MaxPods); min > max {
+			return errors.Errorf("schedule window %q has min-pods %v above max-pods %v", w.Spec, min, max)
+		}
+	}
+	if c.ScaleDownStabilization < 0 || c.ScaleUpStabilization < 0 {
+		return errors.New("scale-down-stabilization and scale-up-stabilization must not be negative")
+	}
+	if c.RateLookahead < 0 {
+		return errors.New("rate-lookahead must not be negative")
+	}
+	if c.RateMinGrowth < 0 {
+		return errors.New("rate-min-growth must not be negative")
+	}
+	if c.RateLookahead > 0 && c.RateWindow <= 0 {
+		return errors.New("rate-window must be above 0 when rate-lookahead is set")
+	}
+	if c.ScalingMode == Throughput && c.PodThroughput == 0 && c.ThroughputSource == BacklogThroughput && c.RateWindow <= 0 {
+		return errors.New("rate-window must be above 0 when pod-throughput is estimated with throughput-source=backlog")
+	}
+	if c.ScaleToZeroIdle < 0 {
+		return errors.New("scale-to-zero-idle must not be negative")
+	}
+	if c.ScaleToZeroIdle > 0 && (c.ActivationReplicas < 1 || c.ActivationReplicas > c.MaxPods) {
+		return errors.Errorf("activation-replicas must be from 1 to max-pods %v, got %v", c.MaxPods, c.ActivationReplicas)
+	}
+	if c.ScaleUpAge < 0 {
+		return errors.New("scale-up-age must not be negative")
+	}
+	if c.VisibleMessagesWeight < 0 || c.InFlightMessagesWeight < 0 || c.DelayedMessagesWeight < 0 {
+		return errors.New("message weights must not be negative")
+	}
+	if c.VisibleMessagesWeight == 0 && c.InFlightMessagesWeight == 0 && c.DelayedMessagesWeight == 0 {
+		return errors.New("at least one of visible-messages-weight, in-flight-messages-weight and delayed-messages-weight must be above 0")
+	}
+	return nil
 }
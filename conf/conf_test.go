@@ -0,0 +1,206 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name string, contents string) string {
+	dir, err := ioutil.TempDir("", "conf")
+	assert.Nil(t, err)
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestParseTarget(t *testing.T) {
+	defaults := Defaults()
+
+	target, err := ParseTarget(defaults, "kubernetes-deployment=worker, sqs-queue-url=https://example.com/worker,max-pods=10")
+	assert.Nil(t, err)
+	assert.Equal(t, "worker", target.KubernetesDeploymentName)
+	assert.Equal(t, "https://example.com/worker", target.SqsQueueUrl)
+	assert.Equal(t, 10, target.MaxPods)
+	assert.Equal(t, defaults.MinPods, target.MinPods, "Settings not in the target should keep their defaults")
+
+	_, err = ParseTarget(defaults, "max-pods=lots")
+	assert.NotNil(t, err)
+	_, err = ParseTarget(defaults, "no-such-flag=1")
+	assert.NotNil(t, err)
+	_, err = ParseTarget(defaults, "max-pods")
+	assert.NotNil(t, err)
+}
+
+func TestParseTargetEscapedComma(t *testing.T) {
+	defaults := Defaults()
+
+	target, err := ParseTarget(defaults, `kubernetes-deployment=worker,sqs-queue-url=https://example.com/worker,schedule=Mon-Fri\,Sun 08:00-18:00 min=3,max-pods=10`)
+	assert.Nil(t, err)
+	assert.Equal(t, "Mon-Fri,Sun 08:00-18:00 min=3", target.Schedule)
+	assert.Equal(t, 10, target.MaxPods)
+	assert.Nil(t, target.Validate())
+
+	target, err = ParseTarget(defaults, `kubernetes-deployment=a\\b`)
+	assert.Nil(t, err)
+	assert.Equal(t, `a\b`, target.KubernetesDeploymentName)
+
+	_, err = ParseTarget(defaults, `kubernetes-deployment=worker\`)
+	assert.NotNil(t, err, "A trailing backslash should be rejected")
+	_, err = ParseTarget(defaults, `kubernetes-deployment=work\er`)
+	assert.NotNil(t, err, "Only commas and backslashes can be escaped")
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+aws-region: eu-west-1
+poll-period: 10s
+scale-up-operator: "*"
+targets:
+  - kubernetes-deployment: worker
+    sqs-queue-url: https://example.com/worker
+  - kubernetes-deployment: mailer
+    sqs-queue-url: https://example.com/mailer
+    max-pods: 1000000
+    active: false
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	base, targets, err := Load(path, Defaults())
+	assert.Nil(t, err)
+	assert.Equal(t, "eu-west-1", base.AwsRegion)
+	assert.Equal(t, path, base.ConfigFile)
+	assert.Equal(t, 2, len(targets))
+
+	assert.Equal(t, "worker", targets[0].KubernetesDeploymentName)
+	assert.Equal(t, 10*time.Second, targets[0].PollInterval)
+	assert.Equal(t, "*", targets[0].ScaleUpOperator)
+	assert.Equal(t, 5, targets[0].MaxPods)
+	assert.True(t, targets[0].Active)
+
+	assert.Equal(t, "mailer", targets[1].KubernetesDeploymentName)
+	assert.Equal(t, 1000000, targets[1].MaxPods)
+	assert.False(t, targets[1].Active)
+}
+
+func TestLoadJSONSingleTarget(t *testing.T) {
+	path := writeConfig(t, "config.json", `{"kubernetes-deployment": "worker", "sqs-queue-url": "https://example.com/worker", "scale-up-amount": 1.5}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	base, targets, err := Load(path, Defaults())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(targets))
+	assert.Equal(t, "worker", base.KubernetesDeploymentName)
+	assert.Equal(t, 1.5, base.ScaleUpAmount)
+	assert.Nil(t, base.Validate())
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, contents := range []string{
+		"no-such-setting: 1\n",
+		"max-pods: lots\n",
+		"poll-period: 30\n",
+		"targets:\n  - kubernetes-deployment: worker\n    bogus: true\n",
+		"targets: worker\n",
+		"aws-region: {name: eu-west-1}\n",
+		"sqs-queue-url: [[https://example.com/a]]\n",
+	} {
+		path := writeConfig(t, "config.yaml", contents)
+		_, _, err := Load(path, Defaults())
+		assert.NotNil(t, err, contents)
+		os.RemoveAll(filepath.Dir(path))
+	}
+
+	_, _, err := Load("/does/not/exist.yaml", Defaults())
+	assert.NotNil(t, err)
+}
+
+func TestLoadQueueList(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+kubernetes-deployment: worker
+sqs-queue-url:
+  - https://example.com/main
+  - https://example.com/retry
+sqs-queue-weights: [1, 0.5]
+sqs-queue-aggregation: max
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	base, _, err := Load(path, Defaults())
+	assert.Nil(t, err)
+	assert.Nil(t, base.Validate())
+	assert.Equal(t, []string{"https://example.com/main", "https://example.com/retry"}, base.QueueUrls())
+	weights, err := base.QueueWeights()
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{1, 0.5}, weights)
+}
+
+func TestValidateQueues(t *testing.T) {
+	c := Defaults()
+	c.KubernetesDeploymentName = "worker"
+	c.SqsQueueUrl = "https://example.com/main https://example.com/retry"
+	assert.Nil(t, c.Validate())
+
+	weights, err := c.QueueWeights()
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{1, 1}, weights, "Queues should have a weight of 1 by default")
+
+	c.SqsQueueWeights = "1"
+	assert.NotNil(t, c.Validate(), "There should be one weight per queue")
+	c.SqsQueueWeights = "1 -1"
+	assert.NotNil(t, c.Validate())
+	c.SqsQueueWeights = ""
+	c.SqsQueueAggregation = "average"
+	assert.NotNil(t, c.Validate())
+}
+
+func TestValidateSchedule(t *testing.T) {
+	c := Defaults()
+	c.KubernetesDeploymentName = "worker"
+	c.SqsQueueUrl = "https://example.com/main"
+	c.Schedule = "Mon-Fri 08:00-18:00 min=3; * 01:45-04:00 max=20"
+	assert.Nil(t, c.Validate())
+
+	c.Schedule = "Mon-Fri 08:00-18:00 min=8"
+	assert.NotNil(t, c.Validate(), "A window min-pods above the base max-pods should be rejected")
+	c.Schedule = "Mon-Fri 08:00-18:00 min=3"
+	c.ScheduleTimezone = "Nowhere/Special"
+	assert.NotNil(t, c.Validate())
+}
+
+func TestValidateBacklogThroughput(t *testing.T) {
+	c := Defaults()
+	c.KubernetesDeploymentName = "worker"
+	c.SqsQueueUrl = "https://example.com/main"
+	c.ScalingMode = Throughput
+	c.ThroughputSource = BacklogThroughput
+	c.RateWindow = 0
+	assert.NotNil(t, c.Validate(), "The backlog throughput source needs a rate-window to measure the drain over")
+
+	c.PodThroughput = 20
+	assert.Nil(t, c.Validate(), "rate-window is not needed when pod-throughput is set")
+	c.PodThroughput = 0
+	c.ThroughputSource = CloudWatchThroughput
+	assert.Nil(t, c.Validate())
+}
+
+func TestValidateSteps(t *testing.T) {
+	c := Defaults()
+	c.KubernetesDeploymentName = "worker"
+	c.SqsQueueUrl = "https://example.com/main"
+	c.ScaleUpSteps = "1000-10000 +1; 10000- =max"
+	c.ScaleDownSteps = "0-10 =min; 10-100 -1"
+	assert.Nil(t, c.Validate())
+
+	c.ScaleUpSteps = "1000-10000 +1; 20000- =max"
+	assert.NotNil(t, c.Validate(), "Steps should be checked whatever the scaling mode")
+	c.ScaleUpSteps = "50- +1"
+	assert.NotNil(t, c.Validate(), "Scale up and down steps should not overlap")
+	c.ScaleUpSteps = ""
+	c.ScaleDownSteps = "0-10 %2"
+	assert.NotNil(t, c.Validate())
+}
@@ -0,0 +1,127 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// Load reads a YAML or JSON config file. Its keys are the flag names, e.g.
+// poll-period or sqs-queue-url, and values are parsed exactly as the flags
+// are. The file is either a single mapping, optionally with a "targets" list
+// whose entries inherit the other settings in the file, or a list of targets.
+//
+// The returned base config holds the file's top level settings applied on top
+// of defaults; targets holds one config per entry in the targets list.
+func Load(path string, defaults MyConfType) (base MyConfType, targets []MyConfType, err error) {
+	base = defaults
+	base.ConfigFile = path
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return base, nil, errors.Wrap(err, "Failed to read config file")
+	}
+
+	// JSON is valid YAML, so both formats go through the same conversion
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return base, nil, errors.Wrapf(err, "%v: invalid YAML or JSON", path)
+	}
+
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return base, nil, errors.Wrapf(err, "%v: invalid YAML or JSON", path)
+	}
+
+	var entries []interface{}
+	switch v := raw.(type) {
+	case nil:
+		return base, nil, nil
+	case []interface{}:
+		entries = v
+	case map[string]interface{}:
+		if err := apply(&base, v, "targets"); err != nil {
+			return base, nil, errors.Wrap(err, path)
+		}
+		if t, ok := v["targets"]; ok {
+			if entries, ok = t.([]interface{}); !ok {
+				return base, nil, errors.Errorf("%v: targets must be a list", path)
+			}
+		}
+	default:
+		return base, nil, errors.Errorf("%v: expected a mapping of settings or a list of targets", path)
+	}
+
+	for i, entry := range entries {
+		settings, ok := entry.(map[string]interface{})
+		if !ok {
+			return base, nil, errors.Errorf("%v: targets[%d]: expected a mapping of settings", path, i)
+		}
+		target := base
+		if err := apply(&target, settings); err != nil {
+			return base, nil, errors.Wrapf(err, "%v: targets[%d]", path, i)
+		}
+		targets = append(targets, target)
+	}
+	return base, targets, nil
+}
+
+// apply sets every key in settings on c, except those listed in skip. Keys are
+// applied in sorted order so errors are reported consistently.
+func apply(c *MyConfType, settings map[string]interface{}, skip ...string) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+outer:
+	for _, key := range keys {
+		for _, s := range skip {
+			if key == s {
+				continue outer
+			}
+		}
+
+		value, err := settingValue(settings[key])
+		if err != nil {
+			return errors.Wrapf(err, "invalid value for %v", key)
+		}
+		if err := c.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settingValue turns a value from the file into the string its flag parses.
+// Lists, e.g. of queue urls, become space separated values.
+func settingValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string, json.Number, bool:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return "", errors.New("expected a list of single values")
+			}
+			s, err := settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, s)
+		}
+		return strings.Join(values, " "), nil
+	default:
+		return "", errors.New("expected a string, number, boolean or list")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+)
+
+type sample struct {
+	time     time.Time
+	messages int
+}
+
+// backlogHistory keeps the backlog readings of a target over a window of time,
+// to tell how fast the backlog is growing or draining.
+type backlogHistory struct {
+	samples []sample
+}
+
+// add records a reading of the backlog, dropping those older than window.
+func (h *backlogHistory) add(now time.Time, messages int, window time.Duration) {
+	h.samples = append(h.samples, sample{time: now, messages: messages})
+	kept := h.samples[:0]
+	for _, s := range h.samples {
+		if now.Sub(s.time) <= window {
+			kept = append(kept, s)
+		}
+	}
+	h.samples = kept
+}
+
+// rate returns the change in the backlog per second, the rate messages arrive
+// less the rate they are worked through. It is the least squares slope of the
+// readings, so a single noisy reading has little sway, and false is returned
+// if there are too few readings to tell.
+func (h *backlogHistory) rate() (float64, bool) {
+	if len(h.samples) < 2 {
+		return 0, false
+	}
+	start := h.samples[0].time
+	var n, sumX, sumY, sumXX, sumXY float64
+	for _, s := range h.samples {
+		x := s.time.Sub(start).Seconds()
+		y := float64(s.messages)
+		n++
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	return (n*sumXY - sumX*sumY) / denominator, true
+}
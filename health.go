@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pollHealth tracks when each running target last polled, for the /healthz
+// and /readyz endpoints.
+type pollHealth struct {
+	sync.Mutex
+	// intervals is how many poll periods a target can go without a
+	// successful poll before it is not ready, or its loop without finishing
+	// a poll before it is stuck
+	intervals int
+	targets   map[string]*targetHealth
+}
+
+type targetHealth struct {
+	pollInterval time.Duration
+	// looping is when the polling loop of the target started, or zero if it
+	// is not running
+	looping     time.Time
+	lastPoll    time.Time
+	lastSuccess time.Time
+}
+
+func newPollHealth(intervals int) *pollHealth {
+	return &pollHealth{intervals: intervals, targets: map[string]*targetHealth{}}
+}
+
+// status is the health of the targets run by this process.
+var status = newPollHealth(5)
+
+// track starts or keeps tracking the target under key, polled every
+// pollInterval.
+func (h *pollHealth) track(key string, pollInterval time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	t, ok := h.targets[key]
+	if !ok {
+		t = &targetHealth{}
+		h.targets[key] = t
+	}
+	t.pollInterval = pollInterval
+}
+
+// forget stops tracking a target that is no longer run.
+func (h *pollHealth) forget(key string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.targets, key)
+}
+
+// running records that the polling loop of the target under key has started.
+func (h *pollHealth) running(key string) {
+	h.Lock()
+	defer h.Unlock()
+	if t, ok := h.targets[key]; ok {
+		t.looping = time.Now()
+		t.lastPoll = time.Time{}
+	}
+}
+
+// polled records a poll of the target under key that failed with err, or
+// succeeded if err is nil. Polls of targets that are not tracked are ignored.
+func (h *pollHealth) polled(key string, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if t, ok := h.targets[key]; ok {
+		t.lastPoll = time.Now()
+		if err == nil {
+			t.lastSuccess = t.lastPoll
+		}
+	}
+}
+
+// notReady returns the targets that have not had a successful poll yet, or
+// have gone more than intervals poll periods without one, e.g. because their
+// queue cannot be read or their loop could not be started.
+func (h *pollHealth) notReady() []string {
+	h.Lock()
+	defer h.Unlock()
+	var failing []string
+	for key, t := range h.targets {
+		if t.lastSuccess.IsZero() || time.Since(t.lastSuccess) > time.Duration(h.intervals)*t.pollInterval {
+			failing = append(failing, key)
+		}
+	}
+	sort.Strings(failing)
+	return failing
+}
+
+// stuck returns the targets whose polling loop has gone more than intervals
+// poll periods without finishing a poll, successful or not, counting from
+// when the loop started if it never finished one. Only a stuck loop is
+// reason to restart the process; a target whose polls fail is not ready.
+func (h *pollHealth) stuck() []string {
+	h.Lock()
+	defer h.Unlock()
+	var stuck []string
+	for key, t := range h.targets {
+		if t.looping.IsZero() {
+			continue
+		}
+		since := t.lastPoll
+		if since.IsZero() {
+			since = t.looping
+		}
+		if time.Since(since) > time.Duration(h.intervals)*t.pollInterval {
+			stuck = append(stuck, key)
+		}
+	}
+	sort.Strings(stuck)
+	return stuck
+}
+
+// healthHandler serves a health check that fails with the targets check
+// returns, if any.
+func healthHandler(check func() []string, problem string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if targets := check(); len(targets) > 0 {
+			http.Error(w, fmt.Sprintf("%v: %v", problem, strings.Join(targets, ", ")), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
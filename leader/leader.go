@@ -0,0 +1,205 @@
+// Package leader elects one of several copies of the autoscaler to do the
+// scaling, using a ConfigMap as the lock.
+package leader
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// Annotation holds the Record of the current leader on the lock ConfigMap.
+// It is the annotation used by the kubernetes components for the same
+// purpose.
+const Annotation = "control-plane.alpha.kubernetes.io/leader"
+
+// Record is who holds the lock and until when.
+type Record struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+	LeaderTransitions    int       `json:"leaderTransitions"`
+}
+
+// ConfigMapClient is the part of the kubernetes client used for the lock.
+type ConfigMapClient interface {
+	ConfigMaps(namespace string) kclient.ConfigMapsInterface
+}
+
+// Elector takes part in the election for the lock Namespace/Name. A leader
+// renews the lock every RetryPeriod and gives up leading if it cannot for
+// RenewDeadline. Others try to take the lock every RetryPeriod, and do once
+// its record has not changed for LeaseDuration, so a standby takes over
+// within LeaseDuration + RetryPeriod of the leader going away.
+type Elector struct {
+	Client        ConfigMapClient
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	// the record last seen and when, local time being used rather than the
+	// times in the record so clock skew between copies does not matter
+	observedRecord Record
+	observedTime   time.Time
+}
+
+// Validate checks the timings of the election: RetryPeriod must be above 0,
+// and RenewDeadline must be below LeaseDuration, so a leader that cannot
+// renew gives up leading before a standby can take over.
+func (e *Elector) Validate() error {
+	if e.RetryPeriod <= 0 {
+		return errors.Errorf("leader-elect-retry-period must be above 0, got %v", e.RetryPeriod)
+	}
+	if e.RenewDeadline >= e.LeaseDuration {
+		return errors.Errorf("leader-elect-renew-deadline %v must be below leader-elect-lease-duration %v", e.RenewDeadline, e.LeaseDuration)
+	}
+	return nil
+}
+
+// Run waits to become the leader, then calls lead in a goroutine and renews
+// the lock until it can no longer. Run returns once leadership is lost, at the
+// latest RenewDeadline after the last renewal even if a renewal is still
+// waiting on the api server; lead is not stopped, so the caller should exit.
+func (e *Elector) Run(lead func()) {
+	log.WithFields(log.Fields{"lock": e.Namespace + "/" + e.Name, "identity": e.Identity}).Info("Waiting to become leader")
+	for !e.tryAcquireOrRenew() {
+		time.Sleep(e.RetryPeriod)
+	}
+	log.WithFields(log.Fields{"lock": e.Namespace + "/" + e.Name, "identity": e.Identity}).Info("Became leader")
+	go lead()
+
+	renewed := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(e.RetryPeriod):
+			}
+			if e.tryAcquireOrRenew() {
+				select {
+				case renewed <- struct{}{}:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+
+	deadline := time.NewTimer(e.RenewDeadline)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-renewed:
+			if !deadline.Stop() {
+				<-deadline.C
+			}
+			deadline.Reset(e.RenewDeadline)
+		case <-deadline.C:
+			log.WithFields(log.Fields{"lock": e.Namespace + "/" + e.Name, "identity": e.Identity}).Error("Failed to renew lock, no longer leader")
+			return
+		}
+	}
+}
+
+// tryAcquireOrRenew takes the lock if it is free or expired, or renews it if
+// already held, returning whether this elector holds it afterwards.
+func (e *Elector) tryAcquireOrRenew() bool {
+	now := time.Now()
+	record := Record{
+		HolderIdentity:       e.Identity,
+		LeaseDurationSeconds: int(e.LeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	configMaps := e.Client.ConfigMaps(e.Namespace)
+	lock, err := configMaps.Get(e.Name)
+	if apierrors.IsNotFound(err) {
+		lock = &api.ConfigMap{ObjectMeta: api.ObjectMeta{Name: e.Name, Namespace: e.Namespace}}
+		if err = setRecord(lock, record); err == nil {
+			_, err = configMaps.Create(lock)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"lock": e.Namespace + "/" + e.Name, "error": err}).Error("Failed to create lock")
+			return false
+		}
+		e.observe(record, now)
+		return true
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"lock": e.Namespace + "/" + e.Name, "error": err}).Error("Failed to get lock")
+		return false
+	}
+
+	current, err := getRecord(lock)
+	if err != nil {
+		log.WithFields(log.Fields{"lock": e.Namespace + "/" + e.Name, "error": err}).Warn("Ignoring unreadable lock record")
+	}
+	if !reflect.DeepEqual(current, e.observedRecord) {
+		e.observe(current, now)
+	}
+	held := current.HolderIdentity == e.Identity
+	if current.HolderIdentity != "" && !held && e.observedTime.Add(e.LeaseDuration).After(now) {
+		return false
+	}
+
+	if held {
+		record.AcquireTime = current.AcquireTime
+		record.LeaderTransitions = current.LeaderTransitions
+	} else {
+		record.LeaderTransitions = current.LeaderTransitions + 1
+	}
+	// the update carries the resourceVersion read, so if another copy took
+	// the lock in between it fails with a conflict
+	if err = setRecord(lock, record); err == nil {
+		_, err = configMaps.Update(lock)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"lock": e.Namespace + "/" + e.Name, "error": err}).Warn("Failed to update lock")
+		return false
+	}
+	e.observe(record, now)
+	return true
+}
+
+func (e *Elector) observe(record Record, now time.Time) {
+	e.observedRecord = record
+	e.observedTime = now
+}
+
+func getRecord(lock *api.ConfigMap) (Record, error) {
+	var record Record
+	value, ok := lock.Annotations[Annotation]
+	if !ok {
+		return record, nil
+	}
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return Record{}, errors.Wrapf(err, "Failed to decode %v annotation", Annotation)
+	}
+	return record, nil
+}
+
+func setRecord(lock *api.ConfigMap, record Record) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to encode %v annotation", Annotation)
+	}
+	if lock.Annotations == nil {
+		lock.Annotations = map[string]string{}
+	}
+	lock.Annotations[Annotation] = string(value)
+	return nil
+}
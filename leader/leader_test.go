@@ -0,0 +1,228 @@
+package leader
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+func newElector(client *MockConfigMapClient, identity string) *Elector {
+	return &Elector{
+		Client:        client,
+		Namespace:     "test",
+		Name:          "lock",
+		Identity:      identity,
+		LeaseDuration: 50 * time.Millisecond,
+		RenewDeadline: 30 * time.Millisecond,
+		RetryPeriod:   5 * time.Millisecond,
+	}
+}
+
+func TestTryAcquireOrRenew(t *testing.T) {
+	client := &MockConfigMapClient{}
+	a := newElector(client, "a")
+	b := newElector(client, "b")
+
+	assert.True(t, a.tryAcquireOrRenew(), "A missing lock should be created and taken")
+	assert.False(t, b.tryAcquireOrRenew(), "A held lock should not be taken")
+	assert.True(t, a.tryAcquireOrRenew(), "The leader should renew the lock")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, a.tryAcquireOrRenew())
+	time.Sleep(40 * time.Millisecond)
+	assert.False(t, b.tryAcquireOrRenew(), "The lease should count from the last renewal seen")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, b.tryAcquireOrRenew(), "An expired lock should be taken over")
+	record, _ := getRecord(client.lock)
+	assert.Equal(t, "b", record.HolderIdentity)
+	assert.Equal(t, 1, record.LeaderTransitions)
+	assert.False(t, a.tryAcquireOrRenew(), "The old leader should not get the lock back")
+}
+
+func TestTryAcquireConflict(t *testing.T) {
+	client := &MockConfigMapClient{}
+	a := newElector(client, "a")
+	assert.True(t, a.tryAcquireOrRenew())
+
+	client.conflicts = 1
+	assert.False(t, a.tryAcquireOrRenew(), "A lock changed since it was read should not be written")
+}
+
+func TestRun(t *testing.T) {
+	client := &MockConfigMapClient{}
+	a := newElector(client, "a")
+	b := newElector(client, "b")
+
+	var mu sync.Mutex
+	var leaders []string
+	lead := func(identity string) func() {
+		return func() {
+			mu.Lock()
+			defer mu.Unlock()
+			leaders = append(leaders, identity)
+		}
+	}
+
+	aDone := make(chan struct{})
+	go func() {
+		a.Run(lead("a"))
+		close(aDone)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go b.Run(lead("b"))
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"a"}, leaders, "Only one copy should lead")
+	mu.Unlock()
+
+	// the leader loses access to the api server, so cannot renew
+	client.Lock()
+	client.failing = "a"
+	client.Unlock()
+	select {
+	case <-aDone:
+	case <-time.After(time.Second):
+		t.Fatal("The leader should stop once it cannot renew the lock")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"a", "b"}, leaders, "The standby should take over once the lease expires")
+	mu.Unlock()
+}
+
+func TestRunStopsWhenRenewHangs(t *testing.T) {
+	client := &MockConfigMapClient{}
+	a := newElector(client, "a")
+
+	done := make(chan struct{})
+	go func() {
+		a.Run(func() {})
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// the api server stops answering the leader
+	client.Lock()
+	client.hanging = make(chan struct{})
+	client.Unlock()
+	defer close(client.hanging)
+	select {
+	case <-done:
+	case <-time.After(a.LeaseDuration):
+		t.Fatal("The leader should stop by the renew deadline even while a renewal hangs")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	e := newElector(&MockConfigMapClient{}, "a")
+	assert.Nil(t, e.Validate())
+
+	e.RenewDeadline = e.LeaseDuration
+	assert.NotNil(t, e.Validate(), "The renew deadline should be below the lease duration")
+
+	e = newElector(&MockConfigMapClient{}, "a")
+	e.RetryPeriod = 0
+	assert.NotNil(t, e.Validate())
+}
+
+// MockConfigMapClient holds a single lock ConfigMap and checks resource
+// versions on update as the api server does.
+type MockConfigMapClient struct {
+	sync.Mutex
+	lock    *api.ConfigMap
+	version int
+	// conflicts is the number of updates to reject as if the lock changed
+	conflicts int
+	// failing is the identity whose calls fail
+	failing string
+	// hanging, if set, blocks every update until it is closed
+	hanging chan struct{}
+}
+
+type MockConfigMaps struct {
+	client *MockConfigMapClient
+}
+
+func (m *MockConfigMapClient) ConfigMaps(namespace string) kclient.ConfigMapsInterface {
+	return &MockConfigMaps{client: m}
+}
+
+func copyConfigMap(c *api.ConfigMap) *api.ConfigMap {
+	copied := *c
+	copied.Annotations = map[string]string{}
+	for k, v := range c.Annotations {
+		copied.Annotations[k] = v
+	}
+	return &copied
+}
+
+func (m *MockConfigMaps) Get(name string) (*api.ConfigMap, error) {
+	m.client.Lock()
+	defer m.client.Unlock()
+	if m.client.lock == nil {
+		return nil, apierrors.NewNotFound(api.Resource("configmaps"), name)
+	}
+	return copyConfigMap(m.client.lock), nil
+}
+
+func (m *MockConfigMaps) Create(c *api.ConfigMap) (*api.ConfigMap, error) {
+	m.client.Lock()
+	defer m.client.Unlock()
+	if m.client.lock != nil {
+		return nil, apierrors.NewAlreadyExists(api.Resource("configmaps"), c.Name)
+	}
+	m.client.version++
+	m.client.lock = copyConfigMap(c)
+	m.client.lock.ResourceVersion = strconv.Itoa(m.client.version)
+	return copyConfigMap(m.client.lock), nil
+}
+
+func (m *MockConfigMaps) Update(c *api.ConfigMap) (*api.ConfigMap, error) {
+	m.client.Lock()
+	hanging := m.client.hanging
+	m.client.Unlock()
+	if hanging != nil {
+		<-hanging
+	}
+
+	m.client.Lock()
+	defer m.client.Unlock()
+	record, _ := getRecord(c)
+	if m.client.failing != "" && record.HolderIdentity == m.client.failing {
+		return nil, fmt.Errorf("connection refused")
+	}
+	if m.client.conflicts > 0 {
+		m.client.conflicts--
+		m.client.version++
+		m.client.lock.ResourceVersion = strconv.Itoa(m.client.version)
+	}
+	if c.ResourceVersion != m.client.lock.ResourceVersion {
+		return nil, apierrors.NewConflict(api.Resource("configmaps"), c.Name, fmt.Errorf("the object has been modified"))
+	}
+	m.client.version++
+	m.client.lock = copyConfigMap(c)
+	m.client.lock.ResourceVersion = strconv.Itoa(m.client.version)
+	return copyConfigMap(m.client.lock), nil
+}
+
+func (m *MockConfigMaps) List(opts api.ListOptions) (*api.ConfigMapList, error) {
+	return nil, nil
+}
+
+func (m *MockConfigMaps) Delete(name string) error {
+	return nil
+}
+
+func (m *MockConfigMaps) Watch(opts api.ListOptions) (watch.Interface, error) {
+	return nil, nil
+}
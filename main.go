@@ -2,118 +2,491 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/leader"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
+	"github.com/uswitch/kube-sqs-autoscaler/monitor"
 	"github.com/uswitch/kube-sqs-autoscaler/scale"
-	"github.com/uswitch/kube-sqs-autoscaler/sqs"
+	"github.com/uswitch/kube-sqs-autoscaler/schedule"
+	"github.com/uswitch/kube-sqs-autoscaler/state"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	// registers the sqs source
+	_ "github.com/uswitch/kube-sqs-autoscaler/sqs"
 )
 
-func Run(p *scale.PodAutoScaler, sqs *sqs.SqsClient, myConf conf.MyConfType) {
-	var changed bool
-	lastScaleUpTime := time.Now()
-	lastScaleDownTime := time.Now()
+// poller holds the state of the polling loop for a single target. The cool
+// off timers live here rather than in the config so they survive reloads.
+type poller struct {
+	p                 *scale.PodAutoScaler
+	src               metric.Source
+	myConf            conf.MyConfType
+	store             state.Store
+	lastScaleUpTime   time.Time
+	lastScaleDownTime time.Time
+	// paused is whether the last poll found scaling paused
+	paused bool
+	// window is the schedule window applied by the last poll, empty if none
+	window string
+	// emptySince is when the queue was first seen empty, zero if it is not
+	emptySince time.Time
+	history    backlogHistory
+	// policy decides the replicas from the backlog, kept across reloads that
+	// do not change the scaling mode
+	policy scale.Policy
+}
+
+func Run(p *scale.PodAutoScaler, src metric.Source, myConf conf.MyConfType) {
+	RunWithUpdates(p, src, myConf, nil, nil)
+}
+
+// RunWithUpdates runs the polling loop like Run, applying every config
+// received on updates before the next poll. The loop returns when updates is
+// closed. If store is set the cool off state is loaded from it, instead of
+// starting with a full cool off, and saved to it after every scale.
+func RunWithUpdates(p *scale.PodAutoScaler, src metric.Source, myConf conf.MyConfType, updates <-chan conf.MyConfType, store state.Store) {
+	pl, err := newPoller(p, src, myConf, store)
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "error": err}).Errorf("Failed to create scaling policy, not polling")
+		return
+	}
+	pl.load()
+	status.running(targetKey(myConf))
 
 	for {
-		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Info("inside polling loop")
+		log.WithFields(log.Fields{"kubernetesDeploymentName": pl.myConf.KubernetesDeploymentName}).Info("inside polling loop")
 		select {
-		case <-time.After(myConf.PollInterval):
-			{
-				numMessages, err := sqs.NumMessages()
-				if err != nil {
-					log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "sqs-queue": myConf.SqsQueueUrl, "error": err}).Errorf("Failed to get SQS messages")
-					continue
-				}
-
-				if numMessages >= myConf.ScaleUpMessages {
-					if lastScaleUpTime.Add(myConf.ScaleUpCoolPeriod).After(time.Now()) {
-						log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Info("Waiting for cool off, skipping scale up ")
-						continue
-					}
-
-					log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "scaleUpMessages": myConf.ScaleUpMessages, "numMessages": numMessages}).Info("Queue size above threshold, scale up may be appropriate, will check replica count next - scaling will only occur if current replicas below maxPods")
-					if changed, err = p.Scale(scale.UP); err != nil {
-						log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed scaling up: %v", err)
-						continue
-					}
-					if changed {
-						lastScaleUpTime = time.Now()
-					}
-				}
-
-				if numMessages <= myConf.ScaleDownMessages {
-					if lastScaleDownTime.Add(myConf.ScaleDownCoolPeriod).After(time.Now()) {
-						log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Info("Waiting for cool off, skipping scale down")
-						continue
-					}
-					log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "scaleDownMessages": myConf.ScaleDownMessages, "numMessages": numMessages}).Info("Queue size below threshold, scale down may be appropriate, will check replica count next  - scaling will only occur if current replicas above minPods")
-					if changed, err = p.Scale(scale.DOWN); err != nil {
-						log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed scaling down: %v", err)
-						continue
-					}
-					if changed {
-						lastScaleDownTime = time.Now()
-					}
-				}
+		case newConf, ok := <-updates:
+			if !ok {
+				log.WithFields(log.Fields{"kubernetesDeploymentName": pl.myConf.KubernetesDeploymentName}).Info("Target removed from config, stopping polling loop")
+				return
 			}
+			pl.update(newConf)
+		case <-time.After(pl.myConf.PollInterval):
+			status.polled(targetKey(pl.myConf), pl.poll())
+		}
+	}
+}
+
+// newPoller creates the poller for a target, with the policy of its scaling
+// mode and a full cool off.
+func newPoller(p *scale.PodAutoScaler, src metric.Source, myConf conf.MyConfType, store state.Store) (*poller, error) {
+	policy, err := scale.NewPolicy(myConf)
+	if err != nil {
+		return nil, err
+	}
+	return &poller{
+		p:                 p,
+		src:               src,
+		myConf:            myConf,
+		store:             store,
+		lastScaleUpTime:   time.Now(),
+		lastScaleDownTime: time.Now(),
+		policy:            policy,
+	}, nil
+}
+
+// load restores the cool off state saved by a previous run, if any.
+func (pl *poller) load() {
+	if pl.store == nil {
+		return
+	}
+	saved, ok, err := pl.store.Load()
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": pl.myConf.KubernetesDeploymentName, "error": err}).Errorf("Failed to load state, starting with a full cool off")
+		return
+	}
+	if !ok {
+		return
+	}
+	log.WithFields(log.Fields{"kubernetesDeploymentName": pl.myConf.KubernetesDeploymentName, "lastScaleUpTime": saved.LastScaleUpTime, "lastScaleDownTime": saved.LastScaleDownTime, "lastDecision": saved.LastDecision}).Info("Loaded state")
+	pl.lastScaleUpTime = saved.LastScaleUpTime
+	pl.lastScaleDownTime = saved.LastScaleDownTime
+	pl.p.Desired = saved.DesiredReplicas
+}
+
+// save stores the cool off state after a scale, with the decision made. The
+// state of a dry run is not saved, so it is not carried over once the target
+// is scaled for real.
+func (pl *poller) save(decision string) {
+	if pl.store == nil || pl.myConf.DryRun {
+		return
+	}
+	err := pl.store.Save(state.State{
+		LastScaleUpTime:   pl.lastScaleUpTime,
+		LastScaleDownTime: pl.lastScaleDownTime,
+		DesiredReplicas:   pl.p.Desired,
+		LastDecision:      decision,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": pl.myConf.KubernetesDeploymentName, "error": err}).Errorf("Failed to save state")
+	}
+}
+
+// update switches the loop to a new config, keeping the cool off state.
+func (pl *poller) update(myConf conf.MyConfType) {
+	log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Infof("Applying new config = %+v ", myConf)
+	c, ok := pl.policy.(scale.ConfigurablePolicy)
+	if ok && myConf.ScalingMode == pl.myConf.ScalingMode {
+		c.Configure(myConf)
+	} else if policy, err := scale.NewPolicy(myConf); err == nil {
+		pl.policy = policy
+	} else {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "error": err}).Errorf("Failed to create scaling policy, keeping the current one")
+	}
+	pl.myConf = myConf
+	pl.p.Configure(myConf)
+	if c, ok := pl.src.(metric.Configurable); ok {
+		c.Configure(myConf)
+	}
+}
+
+// poll checks the backlog once and scales if required, returning an error if
+// either failed. Nothing is scaled while the object is paused with
+// scale.PausedAnnotation. A panic is logged and recovered so one broken target cannot
+// take down the others running in the same process.
+func (pl *poller) poll() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{"kubernetesDeploymentName": pl.myConf.KubernetesDeploymentName, "kubernetesNamespace": pl.myConf.KubernetesNamespace}).Errorf("Polling loop panicked: %v", r)
+			err = errors.Errorf("polling loop panicked: %v", r)
 		}
+	}()
+
+	myConf := pl.myConf
+	backlog, err := pl.src.Backlog()
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "source": myConf.Source, "error": err}).Errorf("Failed to get backlog")
+		return err
+	}
+	numMessages := backlog.Messages
+	monitor.Backlog.WithLabelValues(myConf.KubernetesNamespace, myConf.KubernetesDeploymentName).Set(float64(numMessages))
+	log.WithFields(backlog.Details).WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "source": myConf.Source, "oldestMessageAge": backlog.OldestAge, "numMessages": numMessages}).Info("Got backlog")
+
+	pl.history.add(time.Now(), numMessages, myConf.RateWindow)
+	rate, known := pl.history.rate()
+	if known {
+		monitor.BacklogRate.WithLabelValues(myConf.KubernetesNamespace, myConf.KubernetesDeploymentName).Set(rate)
+	}
+	// with rate-lookahead set, a growing backlog is projected forward, and
+	// scale downs wait until it stops growing; growth below rate-min-growth
+	// is taken as noise
+	rising := myConf.RateLookahead > 0 && known && rate > 0 && rate >= myConf.RateMinGrowth
+	projected := numMessages
+	if rising {
+		projected = numMessages + int(rate*myConf.RateLookahead.Seconds())
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "ratePerSecond": rate, "projectedMessages": projected, "rateLookahead": myConf.RateLookahead}).Info("Backlog growing")
+	}
+
+	paused, err := pl.p.Paused()
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "error": err}).Errorf("Failed to check for pause")
+		return err
+	}
+	if paused {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "annotation": scale.PausedAnnotation}).Info("Scaling paused by annotation, skipping")
+		pl.paused = true
+		return nil
+	}
+	if pl.paused {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "annotation": scale.PausedAnnotation}).Info("Pause annotation removed, resuming scaling")
+		pl.paused = false
+	}
+
+	window, err := pl.applySchedule(numMessages)
+	if err != nil {
+		return err
+	}
+	if myConf.ScaleToZeroIdle > 0 {
+		if handled, err := pl.scaleToZero(backlog, window); handled || err != nil {
+			return err
+		}
+	}
+
+	current, err := pl.p.Replicas()
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed to get current replicas: %v", err)
+		return err
+	}
+	return pl.scaleToTarget(current, scale.Observation{Backlog: backlog, Rate: rate, RateKnown: known, Rising: rising, Projected: projected, Min: pl.p.Min, Max: pl.p.Max})
+}
+
+// applySchedule sets the replica limits of the schedule window that applies
+// now, or of the config outside any window. When the window changes the
+// replicas are brought within the new limits, scaling up to the prescale of a
+// window starting, without waiting for the cool off.
+func (pl *poller) applySchedule(numMessages int) (*schedule.Window, error) {
+	myConf := pl.myConf
+	windows, err := myConf.ScheduleWindows()
+	if err != nil {
+		return nil, err
+	}
+	window := windows.Active(time.Now())
+	min, max := myConf.MinPods, myConf.MaxPods
+	spec := ""
+	if window != nil {
+		min, max = window.Limits(min, max)
+		spec = window.Spec
+	}
+	pl.p.Limit(min, max)
+	if spec == pl.window {
+		return window, nil
+	}
+
+	log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "window": spec, "minPods": min, "maxPods": max}).Info("Schedule window changed, applying its replica limits")
+	current, err := pl.p.Replicas()
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed to get current replicas: %v", err)
+		return nil, err
+	}
+	target := current
+	if window != nil && window.Prescale > target {
+		target = window.Prescale
+	}
+	// a target scaled to zero stays there unless the window sets a min-pods
+	atZero := current == 0 && myConf.ScaleToZeroIdle > 0 && (window == nil || window.Min < 0)
+	if pl.p.Clamp(target) != current && !atZero {
+		reason := "outside schedule windows"
+		if window != nil {
+			reason = fmt.Sprintf("schedule window %q", spec)
+		}
+		if _, err := pl.p.ScaleTo(target, scale.Cause{Messages: numMessages, Reason: reason}); err != nil {
+			log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed scaling for schedule window: %v", err)
+			return nil, err
+		}
+	}
+	pl.window = spec
+	return window, nil
+}
+
+// scaleToZero scales the target to zero once the queue has been empty for
+// scale-to-zero-idle, and straight back up to activation-replicas, without
+// waiting for the threshold or the cool off, as soon as a message arrives. It
+// returns whether it dealt with the poll, which it does whenever the target
+// is at zero so the usual scaling does not bring it back up to min-pods. A
+// schedule window that sets min-pods keeps the target from going to zero.
+func (pl *poller) scaleToZero(backlog metric.Backlog, window *schedule.Window) (handled bool, err error) {
+	myConf := pl.myConf
+	now := time.Now()
+	if !backlog.Empty {
+		pl.emptySince = time.Time{}
+	} else if pl.emptySince.IsZero() {
+		pl.emptySince = now
+	}
+
+	current, err := pl.p.Replicas()
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed to get current replicas: %v", err)
+		return true, err
+	}
+
+	switch {
+	case current == 0 && !backlog.Empty:
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "numMessages": backlog.Messages, "activationReplicas": myConf.ActivationReplicas}).Info("Messages arrived while at zero replicas, activating")
+		cause := scale.Cause{Messages: backlog.Messages, Reason: "messages arrived while scaled to zero"}
+		changed, err := pl.p.Activate(myConf.ActivationReplicas, cause)
+		if err != nil {
+			log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed activating: %v", err)
+			return true, err
+		}
+		if changed {
+			pl.lastScaleUpTime = now
+			pl.save(fmt.Sprintf("activate to %v replicas: %v", pl.p.Desired, cause))
+		}
+		return true, nil
+	case current == 0:
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Info("Queue empty, staying at zero replicas")
+		return true, nil
+	case backlog.Empty && now.Sub(pl.emptySince) >= myConf.ScaleToZeroIdle && (window == nil || window.Min < 0):
+		if pl.lastScaleDownTime.Add(myConf.ScaleDownCoolPeriod).After(now) {
+			log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Info("Waiting for cool off, skipping scale to zero")
+			monitor.CoolOffSkips.WithLabelValues(myConf.KubernetesNamespace, myConf.KubernetesDeploymentName, string(scale.DOWN)).Inc()
+			return true, nil
+		}
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "emptySince": pl.emptySince}).Info("Queue idle, scaling to zero")
+		cause := scale.Cause{Messages: backlog.Messages, Reason: fmt.Sprintf("queue empty for scale-to-zero-idle %v", myConf.ScaleToZeroIdle)}
+		changed, err := pl.p.ScaleToZero(cause)
+		if err != nil {
+			log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed scaling to zero: %v", err)
+			return true, err
+		}
+		if changed {
+			pl.lastScaleDownTime = now
+			pl.save(fmt.Sprintf("scale to zero: %v", cause))
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// scaleToTarget scales from current straight to the replicas the policy
+// decides on from o, obeying the cool off period for the direction it scales
+// in, and not scaling down while the backlog is rising. The decision is
+// recorded with the stabilization windows on every poll, and a scale they
+// hold back is skipped. The stabilized replicas are then forced to the replica
+// limits, and a target beyond them is still asked for when the replicas are at
+// the limit, so the limit is recorded.
+func (pl *poller) scaleToTarget(current int, o scale.Observation) error {
+	myConf := pl.myConf
+	decision := pl.policy.Decide(current, o)
+	target, rising := decision.Replicas, o.Rising
+	cause := scale.Cause{Messages: o.Messages, Reason: decision.Reason}
+	stabilized := pl.p.Stabilize(current, target)
+	desired := pl.p.Clamp(stabilized)
+	monitor.DesiredReplicas.WithLabelValues(myConf.KubernetesNamespace, myConf.KubernetesDeploymentName).Set(float64(desired))
+	if target == current && desired == current {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "numMessages": cause.Messages, "currentReplicas": current, "reason": cause.Reason}).Info("Replicas match the target, no change needed")
+		return nil
+	}
+	if stabilized == current && desired == current {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "currentReplicas": current, "recommendedReplicas": target}).Info("Replicas held by recent recommendations in the stabilization window")
+		return nil
+	}
+
+	down := desired < current || (desired == current && stabilized < current)
+	direction, lastScaleTime, coolPeriod := scale.UP, &pl.lastScaleUpTime, myConf.ScaleUpCoolPeriod
+	if down && rising {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "currentReplicas": current, "desiredReplicas": desired}).Info("Backlog still growing, holding back scale down")
+		return nil
+	}
+	if down {
+		direction, lastScaleTime, coolPeriod = scale.DOWN, &pl.lastScaleDownTime, myConf.ScaleDownCoolPeriod
+	}
+	if lastScaleTime.Add(coolPeriod).After(time.Now()) {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Infof("Waiting for cool off, skipping scale %v", direction)
+		monitor.CoolOffSkips.WithLabelValues(myConf.KubernetesNamespace, myConf.KubernetesDeploymentName, string(direction)).Inc()
+		return nil
+	}
+
+	log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName, "reason": cause.Reason, "numMessages": cause.Messages, "currentReplicas": current, "desiredReplicas": desired}).Info("Replicas do not match the target, scaling")
+	changed, err := pl.p.ScaleWith(pl.policy, o, decision, direction, cause)
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": myConf.KubernetesDeploymentName}).Errorf("Failed scaling %v: %v", direction, err)
+		return err
+	}
+	if changed {
+		*lastScaleTime = time.Now()
+		pl.save(fmt.Sprintf("scale %v to %v replicas: %v", direction, pl.p.Desired, cause))
+	}
+	return nil
+}
+
+// serveHTTP serves the metrics and the health checks. /healthz fails once the
+// polling loop of a target is stuck, and /readyz fails until every target has
+// polled successfully, and again once one goes too long without doing so.
+func serveHTTP(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", monitor.Handler())
+	mux.Handle("/healthz", healthHandler(status.stuck, "polling loop stuck"))
+	mux.Handle("/readyz", healthHandler(status.notReady, "no successful poll recently"))
+	log.Infof("Serving metrics and health checks on %v", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.WithFields(log.Fields{"listenAddress": address, "error": err}).Errorf("Failed to serve metrics and health checks")
 	}
 }
 
 func main() {
-	myConf := conf.MyConfType{}
-
-	flag.DurationVar(&myConf.PollInterval, "poll-period", 30*time.Second, "The interval in seconds for checking if scaling is required")
-	flag.DurationVar(&myConf.ScaleDownCoolPeriod, "scale-down-cool-off", 30*time.Second, "The cool off period for scaling down")
-	flag.DurationVar(&myConf.ScaleUpCoolPeriod, "scale-up-cool-off", 120*time.Second, "The cool off period for scaling up")
-	flag.IntVar(&myConf.ScaleUpMessages, "scale-up-messages", 1000, "Number of sqs messages queued up required for scaling up")
-	flag.IntVar(&myConf.ScaleDownMessages, "scale-down-messages", 0, "Number of messages required to scale down")
-	flag.Float64Var(&myConf.ScaleUpAmount, "scale-up-amount", 1, "The number used to scale up the replicas, used with scale-up-operator, e.g. + 3 or * 2")
-	flag.Float64Var(&myConf.ScaleDownAmount, "scale-down-amount", 1, "The number used to scale down the replicas, used with scale-down-operator, e.g. - 3 or / 2")
-	flag.StringVar(&myConf.ScaleUpOperator, "scale-up-operator", "+", "The operator used to scale up the replicas, used with scale-up-amount, e.g. + 3 or * 2")
-	flag.StringVar(&myConf.ScaleDownOperator, "scale-down-operator", "-", "The operator used to scale down the replicas, used with scale-up-amount, e.g. - 3 or / 2")
-
-	flag.IntVar(&myConf.MaxPods, "max-pods", 5, "Max pods that kube-sqs-autoscaler can scale")
-	flag.IntVar(&myConf.MinPods, "min-pods", 1, "Min pods that kube-sqs-autoscaler can scale")
-	flag.StringVar(&myConf.AwsRegion, "aws-region", "", "Your AWS region")
-
-	flag.StringVar(&myConf.SqsQueueUrl, "sqs-queue-url", "", "The sqs queue url")
-	flag.StringVar(&myConf.KubernetesDeploymentName, "kubernetes-deployment", "", "Kubernetes Deployment to scale. This field is required")
-	flag.StringVar(&myConf.KubernetesNamespace, "kubernetes-namespace", "default", "The namespace your deployment is running in")
-
-	flag.BoolVar(&myConf.Active, "active", true, "true/false - whether autoscaling is active for this deployment. Containers with active=false will terminate with success status")
+	myConf := conf.Defaults()
+	var targetSpecs targetFlags
+	var listenAddress string
+	var leaderElect bool
+	elector := &leader.Elector{}
+
+	conf.RegisterFlags(flag.CommandLine, &myConf)
+	flag.StringVar(&myConf.ConfigFile, "config", "", "Path to a YAML or JSON config file. Its keys are the flag names, and flags given on the command line override values from the file")
+	flag.DurationVar(&myConf.ConfigCheckPeriod, "config-check-period", 10*time.Second, "How often to check the config file for changes. Changes are applied without a restart, as is a SIGHUP")
+	flag.Var(&targetSpecs, "target", "A deployment and queue pair to scale, given as comma separated flag=value pairs, e.g. kubernetes-deployment=worker,sqs-queue-url=https://...,max-pods=10, with \\, for a comma inside a value. Can be repeated; flags not set in a target take the value given on the command line")
+	flag.StringVar(&listenAddress, "listen-address", ":9102", "Address to serve Prometheus metrics on, at /metrics, and the /healthz and /readyz checks. Empty disables it")
+	flag.IntVar(&status.intervals, "unhealthy-polls", status.intervals, "Number of poll periods a target can go without a successful poll before /readyz fails, or its polling loop without finishing a poll before /healthz fails")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Run several copies for availability with only the elected leader scaling. The lock is a ConfigMap in kubernetes-namespace")
+	flag.StringVar(&elector.Name, "leader-elect-lock", "kube-sqs-autoscaler", "Name of the ConfigMap used as the leader election lock")
+	flag.DurationVar(&elector.LeaseDuration, "leader-elect-lease-duration", 15*time.Second, "How long standbys wait after the leader last renewed the lock before taking over")
+	flag.DurationVar(&elector.RenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "How long the leader keeps trying to renew the lock before it stops leading and exits. Must be below leader-elect-lease-duration")
+	flag.DurationVar(&elector.RetryPeriod, "leader-elect-retry-period", 2*time.Second, "How often to try to take or renew the lock")
 	flag.Parse()
 
-	if !myConf.Active {
-		log.Infof("active flag set to false, will not monitor queue")
-		select {}
-		// keep active in kubernetes - sleep forever
+	if listenAddress != "" {
+		go serveHTTP(listenAddress)
 	}
 
-	if myConf.KubernetesDeploymentName == "" {
-		log.Infof("kubernetes-deployment name not set")
+	targets, err := currentTargets(myConf, targetSpecs)
+	if err != nil {
+		log.Infof("%v", err)
 		os.Exit(1)
 	}
-	if myConf.SqsQueueUrl == "" {
-		log.Infof("sqs-queue-url name not set")
-		os.Exit(1)
+
+	if len(targets) == 0 && myConf.ConfigFile == "" {
+		log.Infof("active flag set to false, exiting")
+		os.Exit(0)
+	}
+
+	// watch for SIGHUP from the start, so one sent to a standby waiting to
+	// lead is held until it leads rather than killing it
+	reload := watchConfig(myConf.ConfigFile, myConf.ConfigCheckPeriod)
+
+	if !leaderElect {
+		runTargets(myConf, targetSpecs, targets, reload)
+		return
 	}
-	if myConf.ScaleDownOperator != "*" && myConf.ScaleDownOperator != "/" && myConf.ScaleDownOperator != "+" && myConf.ScaleDownOperator != "-" {
-		log.Infof("scale-down-operator flag %v not in the valid set of *, +, /, - ", myConf.ScaleDownOperator)
+
+	if err := elector.Validate(); err != nil {
+		log.Infof("%v", err)
 		os.Exit(1)
 	}
-	if myConf.ScaleUpOperator != "*" && myConf.ScaleUpOperator != "/" && myConf.ScaleUpOperator != "+" && myConf.ScaleUpOperator != "-" {
-		log.Infof("scale-up-operator flag %v not in the valid set of *, +, /, - ", myConf.ScaleUpOperator)
+	config, err := scale.RestConfig(myConf.Kubeconfig, myConf.KubernetesContext)
+	if err == nil {
+		elector.Client, err = kclient.New(config)
+	}
+	if err != nil {
+		log.Errorf("Failed to create kubernetes client for leader election: %v", err)
 		os.Exit(1)
 	}
+	elector.Namespace = myConf.KubernetesNamespace
+	hostname, _ := os.Hostname()
+	elector.Identity = hostname + "_" + strconv.Itoa(os.Getpid())
 
-	log.Info("Starting kube-sqs-autoscaler for deployment " + myConf.KubernetesDeploymentName + " and namespace " + myConf.KubernetesNamespace)
-	log.Infof("Config = %+v ", myConf)
-	p := scale.NewPodAutoScaler(myConf)
-	sqs := sqs.NewSqsClient(myConf.SqsQueueUrl, myConf.AwsRegion)
+	elector.Run(func() {
+		// the config may have changed while waiting to lead
+		if latest, err := currentTargets(myConf, targetSpecs); err == nil {
+			targets = latest
+		}
+		runTargets(myConf, targetSpecs, targets, reload)
+	})
+	// exiting stops the polling loops, so they do not scale alongside the
+	// new leader
+	log.Errorf("Lost leadership, exiting")
+	os.Exit(1)
+}
 
-	Run(p, sqs, myConf)
+// currentTargets loads and checks the targets to run from the config.
+func currentTargets(myConf conf.MyConfType, targetSpecs targetFlags) ([]conf.MyConfType, error) {
+	targets, err := loadTargets(myConf, targetSpecs)
+	if err != nil {
+		return nil, err
+	}
+	return activeTargets(targets)
+}
+
+// runTargets runs the polling loops for targets, applying changes to the
+// config file whenever reload receives.
+func runTargets(myConf conf.MyConfType, targetSpecs targetFlags, targets []conf.MyConfType, reload <-chan struct{}) {
+	s := newSupervisor()
+	s.apply(targets)
 
+	for range reload {
+		targets, err := currentTargets(myConf, targetSpecs)
+		if err != nil {
+			log.WithFields(log.Fields{"config": myConf.ConfigFile, "error": err}).Errorf("Invalid config, keeping the current one")
+			continue
+		}
+		log.WithFields(log.Fields{"config": myConf.ConfigFile}).Info("Reloading config")
+		s.apply(targets)
+	}
 }
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,8 +23,10 @@ import (
 	"k8s.io/kubernetes/pkg/watch"
 
 	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
 	"github.com/uswitch/kube-sqs-autoscaler/scale"
 	mainsqs "github.com/uswitch/kube-sqs-autoscaler/sqs"
+	"github.com/uswitch/kube-sqs-autoscaler/state"
 )
 
 var speedUp = time.Duration(100)
@@ -33,7 +44,11 @@ var myConf = conf.MyConfType{
 	ScaleUpAmount:            1.0,
 	ScaleDownOperator:        "-",
 	ScaleDownAmount:          1.0,
+	ScalingMode:              conf.StepScaling,
+	Source:                   "sqs",
 	SqsQueueUrl:              "example.com",
+	SqsQueueAggregation:      conf.SumQueues,
+	VisibleMessagesWeight:    1,
 	KubernetesDeploymentName: "test",
 	KubernetesNamespace:      "test",
 }
@@ -130,6 +145,562 @@ func TestRunScaleDownCoolDown(t *testing.T) {
 	log.Info("Pass TestRunScaleDownCoolDown")
 }
 
+func TestRunAppliesConfigUpdates(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunAppliesConfigUpdates")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.ScaleUpCoolPeriod = 1 * time.Second / speedUp
+	testConf.MaxPods = 3
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+	updates := make(chan conf.MyConfType, 1)
+
+	stopped := make(chan struct{})
+	go func() {
+		RunWithUpdates(p, s, testConf, updates, nil)
+		close(stopped)
+	}()
+
+	Attributes := map[string]*string{"ApproximateNumberOfMessages": aws.String("1000")}
+	input := &sqs.SetQueueAttributesInput{
+		Attributes: Attributes,
+	}
+	s.Client.SetQueueAttributes(input)
+
+	time.Sleep(5 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(3), deployment.Spec.Replicas, "Number of replicas should be held at the original max")
+
+	testConf.MaxPods = 5
+	updates <- testConf
+
+	time.Sleep(10 * time.Second / speedUp)
+	deployment, _ = p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(5), deployment.Spec.Replicas, "Number of replicas should reach the updated max")
+
+	close(updates)
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second / speedUp):
+		t.Error("Polling loop should stop when updates is closed")
+	}
+	log.Info("Pass TestRunAppliesConfigUpdates")
+}
+
+// setCommandLine sets a flag on the command line as if it had been given,
+// defining it first if the test binary does not.
+func setCommandLine(t *testing.T, name string, value string) {
+	if flag.Lookup(name) == nil {
+		flag.String(name, "", "")
+	}
+	assert.Nil(t, flag.Set(name, value))
+}
+
+func TestLoadTargetsWithProcessFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "targets")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`
+targets:
+  - kubernetes-deployment: worker
+    sqs-queue-url: https://example.com/worker
+`), 0644))
+
+	// a command line of its own, so the flags set here do not leak into
+	// other tests
+	defer func(commandLine *flag.FlagSet) { flag.CommandLine = commandLine }(flag.CommandLine)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	commandLine := conf.Defaults()
+	conf.RegisterFlags(flag.CommandLine, &commandLine)
+	setCommandLine(t, "max-pods", "7")
+	for _, name := range []string{"listen-address", "unhealthy-polls", "leader-elect", "leader-elect-lock", "leader-elect-lease-duration", "leader-elect-renew-deadline", "leader-elect-retry-period"} {
+		setCommandLine(t, name, "1")
+	}
+
+	loadConf := conf.Defaults()
+	loadConf.ConfigFile = path
+	targets, err := loadTargets(loadConf, nil)
+	assert.Nil(t, err, "Flags of the process should not be applied to the targets")
+	assert.Equal(t, 1, len(targets))
+	assert.Equal(t, 7, targets[0].MaxPods, "Target flags on the command line should override the config file")
+}
+
+func TestSupervisorReportsFailedStart(t *testing.T) {
+	broken := myConf
+	broken.KubernetesDeploymentName = "broken"
+	broken.Source = "unknown"
+
+	s := newSupervisor()
+	s.apply([]conf.MyConfType{broken})
+	assert.Contains(t, status.notReady(), "test/broken", "A target that failed to start should be reported")
+	assert.True(t, s.running[targetKey(broken)].failed)
+
+	memory := s.running[targetKey(broken)].memory
+	s.apply([]conf.MyConfType{broken})
+	assert.True(t, s.running[targetKey(broken)].failed, "A failed target should be started again on reload")
+	assert.True(t, memory == s.running[targetKey(broken)].memory, "The cool off state should be carried over to the restarted target")
+
+	s.apply(nil)
+	assert.NotContains(t, status.notReady(), "test/broken", "A failed target removed from the config should be forgotten")
+}
+
+func TestUnusedQueues(t *testing.T) {
+	removed := myConf
+	removed.SqsQueueUrl = "https://example.com/worker https://example.com/shared"
+	other := myConf
+	other.SqsQueueUrl = "https://example.com/shared"
+
+	assert.Equal(t, []string{"worker"}, unusedQueues(removed, []conf.MyConfType{other}), "Queues still read by another target should be kept")
+	assert.Equal(t, []string{"worker", "shared"}, unusedQueues(removed, nil))
+}
+
+func TestRunningTargetStopWaitsForLoop(t *testing.T) {
+	r := &runningTarget{updates: make(chan conf.MyConfType, 1), done: make(chan struct{})}
+	var polled bool
+	go func() {
+		defer close(r.done)
+		<-r.updates
+		// a poll still in progress when the loop is stopped
+		time.Sleep(10 * time.Millisecond)
+		polled = true
+	}()
+
+	r.stop()
+	assert.True(t, polled, "Stopping a loop should wait for its poll to finish")
+}
+
+func TestActiveTargets(t *testing.T) {
+	inactive := myConf
+	inactive.KubernetesDeploymentName = "inactive"
+	inactive.Active = false
+	inactive.SqsQueueUrl = ""
+
+	active := myConf
+	active.Active = true
+
+	targets, err := activeTargets([]conf.MyConfType{inactive, active})
+	assert.Nil(t, err)
+	assert.Equal(t, []conf.MyConfType{active}, targets, "Inactive targets should be dropped without being validated")
+
+	_, err = activeTargets([]conf.MyConfType{active, active})
+	assert.NotNil(t, err, "The same deployment should not be accepted twice")
+
+	invalid := active
+	invalid.ScaleUpOperator = "%"
+	_, err = activeTargets([]conf.MyConfType{active, invalid})
+	assert.NotNil(t, err)
+
+	unknownSource := active
+	unknownSource.Source = "carrier-pigeon"
+	_, err = activeTargets([]conf.MyConfType{unknownSource})
+	assert.NotNil(t, err)
+}
+
+func TestRunTargetTracking(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunTargetTracking")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.ScalingMode = conf.TargetTracking
+	testConf.TargetMessagesPerPod = 100
+	testConf.MaxPods = 10
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+
+	go Run(p, s, testConf)
+
+	Attributes := map[string]*string{"ApproximateNumberOfMessages": aws.String("750")}
+	input := &sqs.SetQueueAttributesInput{
+		Attributes: Attributes,
+	}
+	s.Client.SetQueueAttributes(input)
+
+	time.Sleep(15 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesDeploymentName).Get("test")
+	assert.Equal(t, int32(8), deployment.Spec.Replicas, "Number of replicas should jump straight to the target in one cool off period")
+	log.Info("Pass TestRunTargetTracking")
+}
+
+func TestRunCountsInFlightMessages(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunCountsInFlightMessages")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.ScaleDownCoolPeriod = 1 * time.Second / speedUp
+	testConf.InFlightMessagesWeight = 1
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+	s.Configure(testConf)
+
+	go Run(p, s, testConf)
+
+	Attributes := map[string]*string{
+		"ApproximateNumberOfMessages":           aws.String("0"),
+		"ApproximateNumberOfMessagesNotVisible": aws.String("50"),
+	}
+	input := &sqs.SetQueueAttributesInput{
+		Attributes: Attributes,
+	}
+	s.Client.SetQueueAttributes(input)
+
+	time.Sleep(10 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesDeploymentName).Get("test")
+	assert.Equal(t, int32(3), deployment.Spec.Replicas, "Number of replicas should not drop while messages are in flight")
+	log.Info("Pass TestRunCountsInFlightMessages")
+}
+
+func TestRunScaleUpOnMessageAge(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunScaleUpOnMessageAge")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.ScaleUpCoolPeriod = 1 * time.Second / speedUp
+	testConf.ScaleUpAge = 5 * time.Minute
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+	s.CloudWatch = &mainsqs.CloudWatchClient{
+		Client: &MockCloudWatch{
+			Datapoints: []*cloudwatch.Datapoint{
+				{Timestamp: aws.Time(time.Now()), Maximum: aws.Float64(600)},
+			},
+		},
+		QueueName: "example",
+	}
+
+	go Run(p, s, testConf)
+
+	time.Sleep(10 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesDeploymentName).Get("test")
+	assert.Equal(t, int32(testConf.MaxPods), deployment.Spec.Replicas, "Number of replicas should be the max while the oldest message is too old")
+	log.Info("Pass TestRunScaleUpOnMessageAge")
+}
+
+func TestRunReportsHealth(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunReportsHealth")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.KubernetesDeploymentName = "healthy"
+	failingConf := testConf
+	failingConf.KubernetesDeploymentName = "failing"
+
+	status.track(targetKey(testConf), testConf.PollInterval)
+	status.track(targetKey(failingConf), failingConf.PollInterval)
+	defer status.forget(targetKey(testConf))
+	defer status.forget(targetKey(failingConf))
+	assert.Equal(t, []string{"test/failing", "test/healthy"}, status.notReady())
+
+	go Run(NewMockPodAutoScaler(testConf), NewMockSqsClient(), testConf)
+	go Run(NewMockPodAutoScaler(failingConf), &MockFailingSource{}, failingConf)
+
+	time.Sleep(10 * time.Second / speedUp)
+	assert.Equal(t, []string{"test/failing"}, status.notReady(), "Only targets that polled successfully should be ready")
+	assert.Empty(t, status.stuck(), "A target whose polls fail should not fail liveness for the others")
+
+	w := httptest.NewRecorder()
+	healthHandler(status.notReady, "no successful poll recently")(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "test/failing")
+
+	status.forget(targetKey(failingConf))
+	w = httptest.NewRecorder()
+	healthHandler(status.notReady, "no successful poll recently")(w, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	log.Info("Pass TestRunReportsHealth")
+}
+
+func TestHealthStuckLoop(t *testing.T) {
+	h := newPollHealth(2)
+	h.track("test/stuck", time.Millisecond)
+	h.track("test/polling", time.Millisecond)
+	h.track("test/not-started", time.Millisecond)
+	h.running("test/stuck")
+	h.running("test/polling")
+
+	time.Sleep(5 * time.Millisecond)
+	h.polled("test/polling", fmt.Errorf("failed"))
+	assert.Equal(t, []string{"test/stuck"}, h.stuck(), "Only a loop that stopped finishing polls should be stuck")
+	assert.Equal(t, []string{"test/not-started", "test/polling", "test/stuck"}, h.notReady())
+
+	w := httptest.NewRecorder()
+	healthHandler(h.stuck, "polling loop stuck")(w, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "test/stuck")
+}
+
+func TestRunPausedByAnnotation(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunPausedByAnnotation")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.ScaleUpCoolPeriod = 1 * time.Second / speedUp
+	testConf.KubernetesDeploymentName = "paused"
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+	client := p.Client.(*MockKubeClient)
+	client.Deployment.Annotations = map[string]string{scale.PausedAnnotation: "true"}
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{"ApproximateNumberOfMessages": aws.String("200")},
+	})
+	status.track(targetKey(testConf), testConf.PollInterval)
+	defer status.forget(targetKey(testConf))
+
+	go Run(p, s, testConf)
+
+	time.Sleep(5 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(3), deployment.Spec.Replicas, "A paused deployment should not be scaled")
+	assert.Empty(t, status.notReady(), "Polls skipped while paused should count as successful")
+
+	client.Deployment.Annotations = nil
+	time.Sleep(5 * time.Second / speedUp)
+	deployment, _ = p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(testConf.MaxPods), deployment.Spec.Replicas, "Scaling should resume once the annotation is removed")
+	log.Info("Pass TestRunPausedByAnnotation")
+}
+
+func TestRunScheduleWindow(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunScheduleWindow")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.Schedule = "* 00:00-24:00 min=4 max=4"
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+
+	go Run(p, s, testConf)
+
+	time.Sleep(5 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(4), deployment.Spec.Replicas, "Replicas should be brought up to the window min-pods as it starts, without waiting for the queue")
+	assert.Equal(t, 4, p.Max)
+	log.Info("Pass TestRunScheduleWindow")
+}
+
+func TestRunScaleToZero(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunScaleToZero")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.ScaleDownCoolPeriod = 1 * time.Second / speedUp
+	testConf.ScaleUpCoolPeriod = time.Hour
+	testConf.ScaleDownMessages = 0
+	testConf.ScaleToZeroIdle = 3 * time.Second / speedUp
+	testConf.ActivationReplicas = 2
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{"ApproximateNumberOfMessages": aws.String("0")},
+	})
+
+	go Run(p, s, testConf)
+
+	time.Sleep(10 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(0), deployment.Spec.Replicas, "An idle queue should be scaled to zero, below min-pods")
+
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{"ApproximateNumberOfMessages": aws.String("1")},
+	})
+	time.Sleep(3 * time.Second / speedUp)
+	deployment, _ = p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(2), deployment.Spec.Replicas, "The first message should activate the target without waiting for the threshold or cool off")
+	log.Info("Pass TestRunScaleToZero")
+}
+
+func TestBacklogRate(t *testing.T) {
+	var h backlogHistory
+	now := time.Now()
+	_, known := h.rate()
+	assert.False(t, known)
+
+	h.add(now.Add(-3*time.Minute), 100, time.Minute)
+	h.add(now.Add(-40*time.Second), 100, time.Minute)
+	h.add(now.Add(-20*time.Second), 250, time.Minute)
+	h.add(now, 300, time.Minute)
+	assert.Len(t, h.samples, 3, "Readings older than the window should be dropped")
+	rate, known := h.rate()
+	assert.True(t, known)
+	assert.InDelta(t, 5, rate, 0.01)
+}
+
+func TestPollScalesOnGrowth(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestPollScalesOnGrowth")
+	testConf.RateWindow = time.Minute
+	testConf.RateLookahead = time.Minute
+	testConf.RateMinGrowth = 1
+
+	growing := newTestPoller(t, NewMockPodAutoScaler(testConf), NewMockSqsClient(), testConf)
+	growing.history.add(time.Now().Add(-20*time.Second), 10, time.Minute)
+	assert.Nil(t, growing.poll())
+	deployment, _ := growing.p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(4), deployment.Spec.Replicas, "A backlog of 50 growing 2 messages/s should be scaled up before reaching 100")
+
+	testConf.ScaleDownMessages = 60
+	testConf.RateLookahead = 30 * time.Second
+	rising := newTestPoller(t, NewMockPodAutoScaler(testConf), NewMockSqsClient(), testConf)
+	rising.history.add(time.Now().Add(-40*time.Second), 0, time.Minute)
+	assert.Nil(t, rising.poll())
+	deployment, _ = rising.p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(3), deployment.Spec.Replicas, "A scale down should be held back while the backlog is rising")
+
+	wobbling := newTestPoller(t, NewMockPodAutoScaler(testConf), NewMockSqsClient(), testConf)
+	wobbling.history.add(time.Now().Add(-50*time.Second), 49, time.Minute)
+	assert.Nil(t, wobbling.poll())
+	deployment, _ = wobbling.p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(2), deployment.Spec.Replicas, "Growth below rate-min-growth should not hold back a scale down")
+
+	draining := newTestPoller(t, NewMockPodAutoScaler(testConf), NewMockSqsClient(), testConf)
+	draining.history.add(time.Now().Add(-20*time.Second), 80, time.Minute)
+	assert.Nil(t, draining.poll())
+	deployment, _ = draining.p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(2), deployment.Spec.Replicas)
+	log.Info("Pass TestPollScalesOnGrowth")
+}
+
+func TestPollStabilizesOnSteadyPolls(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestPollStabilizesOnSteadyPolls")
+	testConf.ScalingMode = conf.TargetTracking
+	testConf.TargetMessagesPerPod = 100
+	testConf.MaxPods = 10
+	testConf.ScaleDownStabilization = 50 * time.Millisecond
+
+	p := NewMockPodAutoScaler(testConf)
+	p.ScaleDownStabilization = testConf.ScaleDownStabilization
+	src := &MockSource{Reading: metric.Backlog{Messages: 600}}
+	pl := newTestPoller(t, p, src, testConf)
+	assert.Nil(t, pl.poll())
+	assert.Equal(t, 6, p.Desired)
+
+	// longer at 6 replicas than the window, polling a steady backlog
+	time.Sleep(2 * testConf.ScaleDownStabilization)
+	assert.Nil(t, pl.poll())
+
+	src.Reading = metric.Backlog{Messages: 100}
+	assert.Nil(t, pl.poll())
+	deployment, _ := p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(6), deployment.Spec.Replicas, "Steady polls within the window should hold back a noisy scale down")
+
+	testConf.MaxPods = 4
+	pl.update(testConf)
+	assert.Nil(t, pl.poll())
+	deployment, _ = p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(4), deployment.Spec.Replicas, "The window should not hold the replicas above max-pods")
+	log.Info("Pass TestPollStabilizesOnSteadyPolls")
+}
+
+// newTestPoller returns a poller for testConf with no cool off running.
+func newTestPoller(t *testing.T, p *scale.PodAutoScaler, src metric.Source, testConf conf.MyConfType) *poller {
+	pl, err := newPoller(p, src, testConf, nil)
+	assert.Nil(t, err)
+	pl.lastScaleUpTime, pl.lastScaleDownTime = time.Time{}, time.Time{}
+	return pl
+}
+
+// estimate returns the throughput estimate of a poller of a throughput target.
+func estimate(pl *poller) float64 {
+	return pl.policy.(*scale.ThroughputPolicy).Estimate(0, scale.Observation{})
+}
+
+func TestPollThroughput(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestPollThroughput")
+	testConf.ScalingMode = conf.Throughput
+	testConf.TargetDrainTime = 5 * time.Minute
+	testConf.ThroughputSource = conf.CloudWatchThroughput
+
+	fixed := testConf
+	fixed.PodThroughput = 0.1
+	pl := newTestPoller(t, NewMockPodAutoScaler(fixed), &MockSource{Reading: metric.Backlog{Messages: 60}}, fixed)
+	assert.Nil(t, pl.poll())
+	deployment, _ := pl.p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(2), deployment.Spec.Replicas, "60 messages at 0.1 messages/s per pod should need 2 pods to drain in 5 minutes")
+
+	src := &MockSource{Reading: metric.Backlog{Messages: 1200, ProcessedRate: 3}}
+	pl = newTestPoller(t, NewMockPodAutoScaler(testConf), src, testConf)
+	assert.Nil(t, pl.poll())
+	deployment, _ = pl.p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(4), deployment.Spec.Replicas, "3 pods processing 3 messages/s should need 4 to drain 1200 messages in 5 minutes")
+
+	src.Reading = metric.Backlog{Messages: 0, ProcessedRate: 0.1}
+	pl.lastScaleDownTime = time.Time{}
+	assert.Nil(t, pl.poll())
+	assert.Equal(t, 1.0, estimate(pl), "The estimate should not be updated while the pods have no backlog")
+
+	fromBacklog := testConf
+	fromBacklog.ThroughputSource = conf.BacklogThroughput
+	fromBacklog.RateWindow = 5 * time.Minute
+	pl = newTestPoller(t, NewMockPodAutoScaler(fromBacklog), &MockSource{Reading: metric.Backlog{Messages: 500}}, fromBacklog)
+	pl.history.add(time.Now().Add(-100*time.Second), 800, fromBacklog.RateWindow)
+	assert.Nil(t, pl.poll())
+	assert.InDelta(t, 1.0, estimate(pl), 0.01, "3 pods draining the backlog 3 messages/s should each process 1 message/s")
+	deployment, _ = pl.p.Client.Deployments(testConf.KubernetesNamespace).Get("test")
+	assert.Equal(t, int32(2), deployment.Spec.Replicas)
+	log.Info("Pass TestPollThroughput")
+}
+
+func TestRunRestoresState(t *testing.T) {
+	testConf := myConf
+	log.Info("Starting TestRunRestoresState")
+	testConf.PollInterval = 1 * time.Second / speedUp
+	testConf.ScaleUpCoolPeriod = time.Hour
+
+	p := NewMockPodAutoScaler(testConf)
+	s := NewMockSqsClient()
+	store := &MockStore{State: state.State{LastScaleUpTime: time.Now().Add(-2 * time.Hour), LastScaleDownTime: time.Now().Add(-2 * time.Hour)}, Saved: true}
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{"ApproximateNumberOfMessages": aws.String("200")},
+	})
+
+	go RunWithUpdates(p, s, testConf, nil, store)
+
+	time.Sleep(5 * time.Second / speedUp)
+	deployment, _ := p.Client.Deployments(testConf.KubernetesDeploymentName).Get("test")
+	assert.Equal(t, int32(4), deployment.Spec.Replicas, "A cool off that ended before the restart should not hold up the first scale, and the next should wait")
+
+	saved, _, _ := store.Load()
+	assert.Equal(t, 4, saved.DesiredReplicas)
+	assert.WithinDuration(t, time.Now(), saved.LastScaleUpTime, time.Second)
+	assert.Equal(t, "scale up to 4 replicas: 200 messages, at or above scale-up-messages 100", saved.LastDecision)
+	log.Info("Pass TestRunRestoresState")
+}
+
+type MockStore struct {
+	sync.Mutex
+	State state.State
+	Saved bool
+}
+
+func (m *MockStore) Load() (state.State, bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.State, m.Saved, nil
+}
+
+func (m *MockStore) Save(s state.State) error {
+	m.Lock()
+	defer m.Unlock()
+	m.State, m.Saved = s, true
+	return nil
+}
+
+type MockSource struct {
+	Reading metric.Backlog
+}
+
+func (m *MockSource) Backlog() (metric.Backlog, error) {
+	return m.Reading, nil
+}
+
+type MockFailingSource struct{}
+
+func (m *MockFailingSource) Backlog() (metric.Backlog, error) {
+	return metric.Backlog{}, fmt.Errorf("access denied")
+}
+
 type MockDeployment struct {
 	client *MockKubeClient
 }
@@ -178,6 +749,28 @@ func (m *MockKubeClient) Deployments(namespace string) kclient.DeploymentInterfa
 	}
 }
 
+type MockScale struct {
+	client *MockKubeClient
+}
+
+func (m *MockScale) Get(kind string, name string) (*extensions.Scale, error) {
+	return &extensions.Scale{
+		ObjectMeta: api.ObjectMeta{Name: name},
+		Spec:       extensions.ScaleSpec{Replicas: m.client.Deployment.Spec.Replicas},
+	}, nil
+}
+
+func (m *MockScale) Update(kind string, scale *extensions.Scale) (*extensions.Scale, error) {
+	m.client.Deployment.Spec.Replicas = scale.Spec.Replicas
+	return scale, nil
+}
+
+func (m *MockKubeClient) Scales(namespace string) kclient.ScaleInterface {
+	return &MockScale{
+		client: m,
+	}
+}
+
 func NewMockKubeClient() *MockKubeClient {
 	return &MockKubeClient{
 		Deployment: &extensions.Deployment{
@@ -192,15 +785,11 @@ func NewMockPodAutoScaler(conf conf.MyConfType) *scale.PodAutoScaler {
 	mockClient := NewMockKubeClient()
 
 	return &scale.PodAutoScaler{
-		Client:            mockClient,
-		Min:               conf.MinPods,
-		Max:               conf.MaxPods,
-		Deployment:        conf.KubernetesDeploymentName,
-		Namespace:         conf.KubernetesNamespace,
-		ScaleUpAmount:     conf.ScaleUpAmount,
-		ScaleDownAmount:   conf.ScaleDownAmount,
-		ScaleUpOperator:   conf.ScaleUpOperator,
-		ScaleDownOperator: conf.ScaleDownOperator,
+		Client:     mockClient,
+		Min:        conf.MinPods,
+		Max:        conf.MaxPods,
+		Deployment: conf.KubernetesDeploymentName,
+		Namespace:  conf.KubernetesNamespace,
 	}
 }
 
@@ -229,5 +818,14 @@ func NewMockSqsClient() *mainsqs.SqsClient {
 			},
 		},
 		QueueUrl: "example.com",
+		Weights:  mainsqs.Weights{Visible: 1},
 	}
 }
+
+type MockCloudWatch struct {
+	Datapoints []*cloudwatch.Datapoint
+}
+
+func (m *MockCloudWatch) GetMetricStatistics(*cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	return &cloudwatch.GetMetricStatisticsOutput{Datapoints: m.Datapoints}, nil
+}
@@ -0,0 +1,95 @@
+package metric
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+)
+
+// Backlog is a reading of the work waiting to be processed by a deployment.
+type Backlog struct {
+	// Messages is the size of the backlog used for scaling decisions
+	Messages int
+	// OldestAge is the age of the oldest message, or 0 if the source does
+	// not know it
+	OldestAge time.Duration
+	// ProcessedRate is the messages worked through per second, or 0 if the
+	// source does not know it
+	ProcessedRate float64
+	// Empty is set when the source knows there are no messages at all, not
+	// even ones in flight or delayed, whatever their weights
+	Empty bool
+	// Details breaks the backlog down for logging, e.g. into visible and
+	// in flight messages
+	Details map[string]interface{}
+}
+
+// Source is anything that can report the backlog of a deployment, e.g. an SQS
+// queue.
+type Source interface {
+	Backlog() (Backlog, error)
+}
+
+// Configurable is implemented by sources that can apply a new config in place
+// when it is reloaded, rather than being created again.
+type Configurable interface {
+	Configure(myConf conf.MyConfType)
+}
+
+// Factory creates a source from a target's config.
+type Factory func(myConf conf.MyConfType) (Source, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+// Register makes a source available by name, for use with the source setting.
+// It is meant to be called from the init function of the package
+// implementing the source, and panics if name is registered twice.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, ok := registry[name]; ok {
+		panic("metric: source " + name + " registered twice")
+	}
+	registry[name] = factory
+}
+
+// Registered returns whether a source called name has been registered.
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	_, ok := registry[name]
+	return ok
+}
+
+// Names returns the names of the registered sources, sorted.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the source named by myConf.Source.
+func New(myConf conf.MyConfType) (Source, error) {
+	registryMu.RLock()
+	factory, ok := registry[myConf.Source]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf("source %v not in the registered set of %v", myConf.Source, Names())
+	}
+	return factory(myConf)
+}
@@ -0,0 +1,46 @@
+package metric
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+)
+
+type MockSource struct {
+	myConf conf.MyConfType
+}
+
+func (m *MockSource) Backlog() (Backlog, error) {
+	return Backlog{Messages: m.myConf.ScaleUpMessages}, nil
+}
+
+func TestRegistry(t *testing.T) {
+	Register("mock", func(myConf conf.MyConfType) (Source, error) {
+		return &MockSource{myConf}, nil
+	})
+	defer func() {
+		registryMu.Lock()
+		delete(registry, "mock")
+		registryMu.Unlock()
+	}()
+
+	assert.True(t, Registered("mock"))
+	assert.False(t, Registered("missing"))
+	assert.Contains(t, Names(), "mock")
+	assert.Panics(t, func() {
+		Register("mock", nil)
+	})
+
+	myConf := conf.Defaults()
+	myConf.Source = "mock"
+	src, err := New(myConf)
+	assert.Nil(t, err)
+	backlog, err := src.Backlog()
+	assert.Nil(t, err)
+	assert.Equal(t, myConf.ScaleUpMessages, backlog.Messages)
+
+	myConf.Source = "missing"
+	_, err = New(myConf)
+	assert.NotNil(t, err)
+}
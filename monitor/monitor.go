@@ -0,0 +1,134 @@
+// Package monitor holds the Prometheus metrics the autoscaler exposes on
+// /metrics.
+package monitor
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "kube_sqs_autoscaler"
+
+var (
+	// QueueMessages is the number of messages last seen on each queue, by
+	// state: visible, in_flight or delayed.
+	QueueMessages = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_messages",
+		Help:      "Number of messages last seen on the queue, by state.",
+	}, []string{"queue", "state"})
+
+	// Backlog is the weighted backlog of a target that scaling decisions are
+	// made on.
+	Backlog = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backlog_messages",
+		Help:      "Backlog of the target after weighting and aggregating its queues.",
+	}, []string{"namespace", "deployment"})
+
+	// BacklogRate is how fast the backlog of a target is changing, negative
+	// while it drains.
+	BacklogRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "backlog_change_per_second",
+		Help:      "Change in the backlog of the target per second over its rate window.",
+	}, []string{"namespace", "deployment"})
+
+	Replicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "replicas",
+		Help:      "Replicas of the scaled object when last read.",
+	}, []string{"namespace", "deployment"})
+
+	DesiredReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "desired_replicas",
+		Help:      "Replicas the autoscaler last decided on.",
+	}, []string{"namespace", "deployment"})
+
+	MinReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "min_replicas",
+		Help:      "Least replicas the autoscaler will scale to.",
+	}, []string{"namespace", "deployment"})
+
+	MaxReplicas = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "max_replicas",
+		Help:      "Most replicas the autoscaler will scale to.",
+	}, []string{"namespace", "deployment"})
+
+	// Scales counts scale attempts by direction and result: success,
+	// unchanged when already at the wanted replicas, error, or dry_run when
+	// the scale was only logged.
+	Scales = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scales_total",
+		Help:      "Scale attempts by direction and result.",
+	}, []string{"namespace", "deployment", "direction", "result"})
+
+	CoolOffSkips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cool_off_skips_total",
+		Help:      "Scales skipped because the cool-off period had not passed.",
+	}, []string{"namespace", "deployment", "direction"})
+
+	// APIErrors and APIDuration cover the calls made to sqs, cloudwatch and
+	// kubernetes.
+	APIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Failed calls to the SQS, CloudWatch and Kubernetes APIs.",
+	}, []string{"api", "operation"})
+
+	APIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of calls to the SQS, CloudWatch and Kubernetes APIs.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "operation"})
+)
+
+func init() {
+	prometheus.MustRegister(QueueMessages)
+	prometheus.MustRegister(Backlog)
+	prometheus.MustRegister(BacklogRate)
+	prometheus.MustRegister(Replicas)
+	prometheus.MustRegister(DesiredReplicas)
+	prometheus.MustRegister(MinReplicas)
+	prometheus.MustRegister(MaxReplicas)
+	prometheus.MustRegister(Scales)
+	prometheus.MustRegister(CoolOffSkips)
+	prometheus.MustRegister(APIErrors)
+	prometheus.MustRegister(APIDuration)
+}
+
+// ObserveRequest records the latency of an api call that started at start,
+// and counts it as failed if err is set.
+func ObserveRequest(api string, operation string, start time.Time, err error) {
+	APIDuration.WithLabelValues(api, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		APIErrors.WithLabelValues(api, operation).Inc()
+	}
+}
+
+// Forget drops the metrics of a target that is no longer scaled, and the
+// QueueMessages of queues, the queues no other target reads, so stale values
+// are not reported for them.
+func Forget(namespace string, deployment string, queues []string) {
+	for _, gauge := range []*prometheus.GaugeVec{Backlog, BacklogRate, Replicas, DesiredReplicas, MinReplicas, MaxReplicas} {
+		gauge.DeleteLabelValues(namespace, deployment)
+	}
+	for _, queue := range queues {
+		for _, state := range []string{"visible", "in_flight", "delayed"} {
+			QueueMessages.DeleteLabelValues(queue, state)
+		}
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return prometheus.Handler()
+}
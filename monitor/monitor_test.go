@@ -0,0 +1,53 @@
+package monitor
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T) string {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestHandler(t *testing.T) {
+	// the metrics are global, so start from nothing to pass when run again
+	APIDuration.Reset()
+	APIErrors.Reset()
+	Scales.Reset()
+
+	ObserveRequest("sqs", "get_queue_attributes", time.Now(), nil)
+	ObserveRequest("sqs", "get_queue_attributes", time.Now(), errors.New("throttled"))
+	Replicas.WithLabelValues("test", "worker").Set(3)
+	Scales.WithLabelValues("test", "worker", "up", "success").Inc()
+	QueueMessages.WithLabelValues("worker", "visible").Set(10)
+	QueueMessages.WithLabelValues("shared", "visible").Set(20)
+
+	body := scrape(t)
+	assert.Contains(t, body, `kube_sqs_autoscaler_api_request_duration_seconds_count{api="sqs",operation="get_queue_attributes"} 2`)
+	assert.Contains(t, body, `kube_sqs_autoscaler_api_errors_total{api="sqs",operation="get_queue_attributes"} 1`)
+	assert.Contains(t, body, `kube_sqs_autoscaler_replicas{deployment="worker",namespace="test"} 3`)
+	assert.Contains(t, body, `kube_sqs_autoscaler_scales_total{deployment="worker",direction="up",namespace="test",result="success"} 1`)
+
+	assert.Contains(t, body, `kube_sqs_autoscaler_queue_messages{queue="worker",state="visible"} 10`)
+
+	Forget("test", "worker", []string{"worker"})
+	body = scrape(t)
+	assert.NotContains(t, body, `kube_sqs_autoscaler_replicas{deployment="worker"`, "Gauges of a removed target should not be reported")
+	assert.NotContains(t, body, `kube_sqs_autoscaler_queue_messages{queue="worker"`, "Queues of a removed target should not be reported")
+	assert.Contains(t, body, `kube_sqs_autoscaler_queue_messages{queue="shared",state="visible"} 20`, "Queues still read by other targets should be kept")
+	assert.Contains(t, body, `kube_sqs_autoscaler_scales_total{deployment="worker"`, "Counters should be kept")
+}
@@ -0,0 +1,136 @@
+package scale
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// Cause is why a scale was asked for, given in the events recorded about it.
+type Cause struct {
+	// Messages is the backlog of the queue
+	Messages int
+	// Reason is the threshold crossed, e.g. "at or above scale-up-messages 1000"
+	Reason string
+}
+
+func (c Cause) String() string {
+	if c.Reason == "" {
+		return fmt.Sprintf("%v messages", c.Messages)
+	}
+	return fmt.Sprintf("%v messages, %v", c.Messages, c.Reason)
+}
+
+// Recorder records Events about the scaled object, like the ones the
+// HorizontalPodAutoscaler leaves on the objects it scales.
+type Recorder interface {
+	Event(object api.ObjectReference, eventType string, reason string, message string)
+}
+
+// EventClient is the part of the kubernetes client used to record Events.
+type EventClient interface {
+	Events(namespace string) kclient.EventInterface
+}
+
+// KubeRecorder records Events through the api server, so they show in
+// kubectl describe.
+type KubeRecorder struct {
+	Client EventClient
+}
+
+func (r *KubeRecorder) Event(object api.ObjectReference, eventType string, reason string, message string) {
+	now := unversioned.Now()
+	event := &api.Event{
+		ObjectMeta: api.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", object.Name, now.UnixNano()),
+			Namespace: object.Namespace,
+		},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Source:         api.EventSource{Component: "kube-sqs-autoscaler"},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+	}
+	if _, err := r.Client.Events(object.Namespace).Create(event); err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": object.Name, "reason": reason, "error": err}).Warn("Failed to record event")
+	}
+}
+
+// reference returns the kind and apiVersion of the objects of kind k, for
+// events to refer to them by.
+func (k Kind) reference() (string, string) {
+	if k.Path == "" {
+		if k.Name == "" {
+			return "Deployment", "extensions/v1beta1"
+		}
+		return k.Name, "extensions/v1beta1"
+	}
+	kind := k.ObjectKind
+	if kind == "" {
+		kind = k.Name
+	}
+	return kind, strings.TrimPrefix(strings.TrimPrefix(k.Path, "/apis/"), "/api/")
+}
+
+func (p *PodAutoScaler) event(scale *Scale, eventType string, reason string, message string) {
+	if p.Recorder == nil {
+		return
+	}
+	kind, apiVersion := p.Kind.reference()
+	p.Recorder.Event(api.ObjectReference{
+		Kind:            kind,
+		APIVersion:      apiVersion,
+		Name:            p.Deployment,
+		Namespace:       p.Namespace,
+		UID:             scale.UID,
+		ResourceVersion: scale.ResourceVersion,
+	}, eventType, reason, message)
+}
+
+// recordScale records the outcome of a scale from currentReplicas to
+// newReplicas. Nothing is recorded if the replicas were left alone.
+func (p *PodAutoScaler) recordScale(scale *Scale, currentReplicas int, newReplicas int, direction Direction, cause Cause, changed bool, err error) {
+	switch {
+	case err != nil:
+		p.event(scale, api.EventTypeWarning, "FailedScale", fmt.Sprintf("Failed to scale %v from %v to %v replicas (%v): %v", direction, currentReplicas, newReplicas, cause, err))
+	case changed && p.DryRun:
+		reason := "WouldScaleUp"
+		if direction == DOWN {
+			reason = "WouldScaleDown"
+		}
+		p.event(scale, api.EventTypeNormal, reason, fmt.Sprintf("Dry run, would have scaled %v from %v to %v replicas: %v", direction, currentReplicas, newReplicas, cause))
+	case changed:
+		reason := "ScaledUp"
+		if direction == DOWN {
+			reason = "ScaledDown"
+		}
+		p.event(scale, api.EventTypeNormal, reason, fmt.Sprintf("Scaled %v from %v to %v replicas: %v", direction, currentReplicas, newReplicas, cause))
+	}
+}
+
+// recordLimit records a warning when the replicas wanted are outside the
+// permitted range. It is recorded once when the limit is first hit rather
+// than on every poll that stays there.
+func (p *PodAutoScaler) recordLimit(scale *Scale, wanted int, newReplicas int, cause Cause) {
+	if wanted == newReplicas {
+		p.limited = ""
+		return
+	}
+
+	reason, limit := "ReplicasAtMax", "max-pods"
+	if wanted < newReplicas {
+		reason, limit = "ReplicasAtMin", "min-pods"
+	}
+	if p.limited == reason {
+		return
+	}
+	p.limited = reason
+	p.event(scale, api.EventTypeWarning, reason, fmt.Sprintf("Wanted %v replicas but limited to %v %v: %v", wanted, limit, newReplicas, cause))
+}
@@ -0,0 +1,264 @@
+package scale
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/steps"
+)
+
+func init() {
+	RegisterPolicy(conf.StepScaling, NewStepPolicy)
+	RegisterPolicy(conf.TargetTracking, NewTargetTrackingPolicy)
+	RegisterPolicy(conf.Throughput, NewThroughputPolicy)
+	RegisterPolicy(conf.StepTableScaling, NewStepTablePolicy)
+}
+
+var operators = map[string]func(replicas float64, amount float64) float64{
+	"*": func(replicas float64, amount float64) float64 { return replicas * amount },
+	"/": func(replicas float64, amount float64) float64 { return replicas / amount },
+	"+": func(replicas float64, amount float64) float64 { return replicas + amount },
+	"-": func(replicas float64, amount float64) float64 { return replicas - amount },
+}
+
+// Operator steps replicas by Amount with one of the operators *, /, + or -.
+type Operator struct {
+	Op     string
+	Amount float64
+}
+
+// ParseOperator returns the Operator for op and amount, or an error naming
+// the setting if op is not one of *, /, + or -.
+func ParseOperator(setting string, op string, amount float64) (Operator, error) {
+	if _, ok := operators[op]; !ok {
+		return Operator{}, errors.Errorf("%v flag %v not in the valid set of *, +, /, - ", setting, op)
+	}
+	return Operator{Op: op, Amount: amount}, nil
+}
+
+// Apply returns replicas stepped by the operator, or replicas unchanged if the
+// operator is not valid.
+func (o Operator) Apply(replicas int) int {
+	apply, ok := operators[o.Op]
+	if !ok {
+		return replicas
+	}
+	return int(apply(float64(replicas), o.Amount))
+}
+
+// StepPolicy steps the replicas up with the scale up operator when the
+// backlog reaches scale-up-messages, its oldest message reaches scale-up-age
+// or it is growing past scale-up-messages within rate-lookahead, and down
+// with the scale down operator when it falls to scale-down-messages.
+type StepPolicy struct {
+	UpMessages    int
+	DownMessages  int
+	UpAge         time.Duration
+	RateLookahead time.Duration
+	Up            Operator
+	Down          Operator
+}
+
+// NewStepPolicy creates a StepPolicy from the thresholds and operators of
+// myConf.
+func NewStepPolicy(myConf conf.MyConfType) (Policy, error) {
+	p := &StepPolicy{}
+	if err := p.configure(myConf); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *StepPolicy) configure(myConf conf.MyConfType) error {
+	down, err := ParseOperator("scale-down-operator", myConf.ScaleDownOperator, myConf.ScaleDownAmount)
+	if err != nil {
+		return err
+	}
+	up, err := ParseOperator("scale-up-operator", myConf.ScaleUpOperator, myConf.ScaleUpAmount)
+	if err != nil {
+		return err
+	}
+	*p = StepPolicy{
+		UpMessages:    myConf.ScaleUpMessages,
+		DownMessages:  myConf.ScaleDownMessages,
+		UpAge:         myConf.ScaleUpAge,
+		RateLookahead: myConf.RateLookahead,
+		Up:            up,
+		Down:          down,
+	}
+	return nil
+}
+
+// Configure applies the thresholds and operators of a reloaded config, which
+// has already been validated.
+func (p *StepPolicy) Configure(myConf conf.MyConfType) {
+	p.configure(myConf)
+}
+
+func (p *StepPolicy) Decide(current int, o Observation) Decision {
+	switch {
+	case o.Messages >= p.UpMessages:
+		return Decision{Replicas: p.Up.Apply(current), Reason: fmt.Sprintf("at or above scale-up-messages %v", p.UpMessages)}
+	case p.UpAge > 0 && o.OldestAge >= p.UpAge:
+		// messages waiting too long mean the current replicas are not keeping up
+		return Decision{Replicas: p.Up.Apply(current), Reason: fmt.Sprintf("oldest message %v old, at or above scale-up-age %v", o.OldestAge, p.UpAge)}
+	case o.Rising && o.Projected >= p.UpMessages:
+		return Decision{Replicas: p.Up.Apply(current), Reason: fmt.Sprintf("growing %.1f messages/s to %v within rate-lookahead %v, at or above scale-up-messages %v", o.Rate, o.Projected, p.RateLookahead, p.UpMessages)}
+	case o.Messages <= p.DownMessages:
+		return Decision{Replicas: p.Down.Apply(current), Reason: fmt.Sprintf("at or below scale-down-messages %v", p.DownMessages)}
+	}
+	return Decision{Replicas: current, Reason: fmt.Sprintf("between scale-down-messages %v and scale-up-messages %v", p.DownMessages, p.UpMessages)}
+}
+
+// StepTablePolicy changes the replicas as set for the band the backlog is in,
+// in Up, or the projected backlog while it is rising, or else in Down. A band
+// of Up never scales down and one of Down never scales up.
+type StepTablePolicy struct {
+	Up   steps.Table
+	Down steps.Table
+}
+
+// NewStepTablePolicy creates a StepTablePolicy from the scale-up-steps and
+// scale-down-steps of myConf, at least one of which must be set.
+func NewStepTablePolicy(myConf conf.MyConfType) (Policy, error) {
+	up, down, err := myConf.StepTables()
+	if err != nil {
+		return nil, err
+	}
+	if len(up.Bands) == 0 && len(down.Bands) == 0 {
+		return nil, errors.Errorf("scaling-mode %v needs scale-up-steps or scale-down-steps", conf.StepTableScaling)
+	}
+	return &StepTablePolicy{Up: up, Down: down}, nil
+}
+
+// Configure applies the steps of a reloaded config, which has already been
+// validated.
+func (p *StepTablePolicy) Configure(myConf conf.MyConfType) {
+	p.Up, p.Down, _ = myConf.StepTables()
+}
+
+func (p *StepTablePolicy) Decide(current int, o Observation) Decision {
+	if band := p.Up.Band(o.Projected); band != nil {
+		return Decision{Replicas: max(applyBand(band, current, o), current), Reason: fmt.Sprintf("scale-up-steps %q", band.Spec)}
+	}
+	if band := p.Down.Band(o.Messages); band != nil {
+		return Decision{Replicas: min(applyBand(band, current, o), current), Reason: fmt.Sprintf("scale-down-steps %q", band.Spec)}
+	}
+	return Decision{Replicas: current, Reason: "outside scale-up-steps and scale-down-steps"}
+}
+
+// applyBand returns the replicas after the change of band to current.
+func applyBand(band *steps.Band, current int, o Observation) int {
+	switch {
+	case band.Limit == "max":
+		return o.Max
+	case band.Limit == "min":
+		return o.Min
+	case band.Op == "=":
+		return int(band.Amount)
+	}
+	return Operator{Op: band.Op, Amount: band.Amount}.Apply(current)
+}
+
+// TargetTrackingPolicy keeps MessagesPerPod messages of the backlog, or of
+// the projected backlog while it is rising, queued per replica.
+type TargetTrackingPolicy struct {
+	MessagesPerPod int
+}
+
+// NewTargetTrackingPolicy creates a TargetTrackingPolicy from the
+// target-messages-per-pod of myConf.
+func NewTargetTrackingPolicy(myConf conf.MyConfType) (Policy, error) {
+	if myConf.TargetMessagesPerPod <= 0 {
+		return nil, errors.Errorf("target-messages-per-pod must be above 0, got %v", myConf.TargetMessagesPerPod)
+	}
+	return &TargetTrackingPolicy{MessagesPerPod: myConf.TargetMessagesPerPod}, nil
+}
+
+// Configure applies the target-messages-per-pod of a reloaded config.
+func (p *TargetTrackingPolicy) Configure(myConf conf.MyConfType) {
+	p.MessagesPerPod = myConf.TargetMessagesPerPod
+}
+
+func (p *TargetTrackingPolicy) Decide(current int, o Observation) Decision {
+	return Decision{Replicas: TargetReplicas(o.Projected, p.MessagesPerPod), Reason: fmt.Sprintf("target-messages-per-pod %v", p.MessagesPerPod)}
+}
+
+// ThroughputPolicy wants the replicas needed to work through the backlog, or
+// the projected backlog while it is rising, within DrainTime at the
+// throughput of each replica.
+type ThroughputPolicy struct {
+	Deployment    string
+	DrainTime     time.Duration
+	PodThroughput float64
+	Source        string
+	// estimate is the last estimate of the messages each replica works
+	// through per second
+	estimate float64
+}
+
+// NewThroughputPolicy creates a ThroughputPolicy from the throughput
+// settings of myConf.
+func NewThroughputPolicy(myConf conf.MyConfType) (Policy, error) {
+	if myConf.TargetDrainTime <= 0 {
+		return nil, errors.Errorf("target-drain-time must be above 0, got %v", myConf.TargetDrainTime)
+	}
+	if myConf.PodThroughput < 0 {
+		return nil, errors.Errorf("pod-throughput must not be negative, got %v", myConf.PodThroughput)
+	}
+	if myConf.ThroughputSource != conf.CloudWatchThroughput && myConf.ThroughputSource != conf.BacklogThroughput {
+		return nil, errors.Errorf("throughput-source %v not in the valid set of %v, %v", myConf.ThroughputSource, conf.CloudWatchThroughput, conf.BacklogThroughput)
+	}
+	p := &ThroughputPolicy{}
+	p.Configure(myConf)
+	return p, nil
+}
+
+// Configure applies the throughput settings of a reloaded config, keeping
+// the estimate.
+func (p *ThroughputPolicy) Configure(myConf conf.MyConfType) {
+	p.Deployment = myConf.KubernetesDeploymentName
+	p.DrainTime = myConf.TargetDrainTime
+	p.PodThroughput = myConf.PodThroughput
+	p.Source = myConf.ThroughputSource
+}
+
+func (p *ThroughputPolicy) Decide(current int, o Observation) Decision {
+	perPod := p.Estimate(current, o)
+	if perPod <= 0 {
+		return Decision{Replicas: current, Reason: fmt.Sprintf("throughput of the replicas not known yet from throughput-source %v", p.Source)}
+	}
+	return Decision{
+		Replicas: int(math.Ceil(float64(o.Projected) / (perPod * p.DrainTime.Seconds()))),
+		Reason:   fmt.Sprintf("%.1f messages/s per pod, target-drain-time %v", perPod, p.DrainTime),
+	}
+}
+
+// Estimate returns the messages each replica works through per second:
+// pod-throughput if set, or else the processed rate shared between the
+// current replicas. The estimate is only updated while there is a backlog,
+// as replicas with nothing to do process fewer messages than they can, and
+// the last one is kept when the rate cannot be measured, e.g. from the
+// backlog while it is growing.
+func (p *ThroughputPolicy) Estimate(current int, o Observation) float64 {
+	if p.PodThroughput > 0 {
+		return p.PodThroughput
+	}
+
+	processed := o.ProcessedRate
+	if p.Source == conf.BacklogThroughput {
+		processed = 0
+		if o.RateKnown && o.Rate < 0 {
+			processed = -o.Rate
+		}
+	}
+	if processed > 0 && current > 0 && o.Messages > 0 {
+		p.estimate = processed / float64(current)
+		log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "processedPerSecond": processed, "currentReplicas": current, "podThroughput": p.estimate}).Info("Estimated throughput of the replicas")
+	}
+	return p.estimate
+}
@@ -0,0 +1,96 @@
+package scale
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
+)
+
+// Observation is what was seen of a target's backlog on one poll.
+type Observation struct {
+	metric.Backlog
+	// Rate is the change in the backlog per second, if RateKnown
+	Rate      float64
+	RateKnown bool
+	// Rising is set when the backlog is growing and rate-lookahead is set, and
+	// Projected is then the backlog Rate would build up within rate-lookahead.
+	// Otherwise Projected is the backlog as it is.
+	Rising    bool
+	Projected int
+	// Min and Max are the replica limits in force, e.g. of a schedule window
+	Min int
+	Max int
+}
+
+// Decision is the replicas a Policy wants and why.
+type Decision struct {
+	Replicas int
+	// Reason is what the replicas were decided from, e.g. "at or above
+	// scale-up-messages 1000", for the logs and events
+	Reason string
+}
+
+// Policy decides the replicas a target should have. Policies that keep state
+// between polls, e.g. an estimate, can also implement ConfigurablePolicy to
+// take a reloaded config without losing it.
+type Policy interface {
+	// Decide returns the replicas wanted for a target at current replicas. A
+	// decision of current replicas means no scale is wanted.
+	Decide(current int, o Observation) Decision
+}
+
+// ConfigurablePolicy is implemented by policies that can apply a new config
+// in place when it is reloaded, rather than being created again.
+type ConfigurablePolicy interface {
+	Policy
+	Configure(myConf conf.MyConfType)
+}
+
+// PolicyFactory creates a policy from a target's config, returning an error
+// if the settings the policy uses are invalid.
+type PolicyFactory func(myConf conf.MyConfType) (Policy, error)
+
+var (
+	policiesMu sync.RWMutex
+	policies   = map[string]PolicyFactory{}
+)
+
+// RegisterPolicy makes a policy available by name, for use with the
+// scaling-mode setting. It panics if name is registered twice.
+func RegisterPolicy(name string, factory PolicyFactory) {
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+
+	if _, ok := policies[name]; ok {
+		panic("scale: policy " + name + " registered twice")
+	}
+	policies[name] = factory
+}
+
+// PolicyNames returns the names of the registered policies, sorted.
+func PolicyNames() []string {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewPolicy creates the policy named by myConf.ScalingMode.
+func NewPolicy(myConf conf.MyConfType) (Policy, error) {
+	policiesMu.RLock()
+	factory, ok := policies[myConf.ScalingMode]
+	policiesMu.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf("scaling-mode %v not in the registered set of %v", myConf.ScalingMode, PolicyNames())
+	}
+	return factory(myConf)
+}
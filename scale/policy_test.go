@@ -0,0 +1,127 @@
+package scale
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
+)
+
+type fixedPolicy struct {
+	replicas int
+}
+
+func (p fixedPolicy) Decide(current int, o Observation) Decision {
+	return Decision{Replicas: p.replicas, Reason: "fixed"}
+}
+
+func TestNewPolicy(t *testing.T) {
+	RegisterPolicy("fixed", func(myConf conf.MyConfType) (Policy, error) {
+		return fixedPolicy{replicas: myConf.MaxPods}, nil
+	})
+	defer func() {
+		policiesMu.Lock()
+		delete(policies, "fixed")
+		policiesMu.Unlock()
+	}()
+	assert.Panics(t, func() { RegisterPolicy("fixed", nil) })
+	assert.Equal(t, []string{"fixed", conf.StepScaling, conf.StepTableScaling, conf.TargetTracking, conf.Throughput}, PolicyNames())
+
+	myConf := conf.Defaults()
+	myConf.ScalingMode = "fixed"
+	myConf.MaxPods = 7
+	policy, err := NewPolicy(myConf)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, policy.Decide(3, Observation{}).Replicas)
+
+	myConf.ScalingMode = "unknown"
+	_, err = NewPolicy(myConf)
+	assert.NotNil(t, err)
+
+	myConf.ScalingMode = conf.StepScaling
+	myConf.ScaleUpOperator = "%"
+	_, err = NewPolicy(myConf)
+	assert.NotNil(t, err, "The step policy should reject an unknown operator")
+
+	myConf.ScalingMode = conf.TargetTracking
+	myConf.TargetMessagesPerPod = 0
+	_, err = NewPolicy(myConf)
+	assert.NotNil(t, err)
+
+	myConf.ScalingMode = conf.Throughput
+	myConf.ThroughputSource = "unknown"
+	_, err = NewPolicy(myConf)
+	assert.NotNil(t, err)
+}
+
+func TestOperator(t *testing.T) {
+	assert.Equal(t, 6, Operator{Op: "*", Amount: 2}.Apply(3))
+	assert.Equal(t, 1, Operator{Op: "/", Amount: 2}.Apply(3))
+	assert.Equal(t, 5, Operator{Op: "+", Amount: 2}.Apply(3))
+	assert.Equal(t, 1, Operator{Op: "-", Amount: 2}.Apply(3))
+
+	_, err := ParseOperator("scale-up-operator", "%", 2)
+	assert.NotNil(t, err)
+}
+
+func TestStepPolicy(t *testing.T) {
+	myConf := conf.Defaults()
+	myConf.ScaleUpMessages = 100
+	myConf.ScaleDownMessages = 10
+	myConf.ScaleUpAge = time.Minute
+	myConf.ScaleUpOperator = "+"
+	myConf.ScaleDownOperator = "-"
+	myConf.ScaleUpAmount = 2
+	myConf.ScaleDownAmount = 1
+	policy, err := NewPolicy(myConf)
+	assert.Nil(t, err)
+
+	observe := func(messages int, oldestAge time.Duration) Observation {
+		return Observation{Backlog: metric.Backlog{Messages: messages, OldestAge: oldestAge}, Projected: messages}
+	}
+	assert.Equal(t, 5, policy.Decide(3, observe(100, 0)).Replicas)
+	assert.Equal(t, 5, policy.Decide(3, observe(50, time.Minute)).Replicas, "Old messages should scale up")
+	assert.Equal(t, 3, policy.Decide(3, observe(50, 0)).Replicas)
+	assert.Equal(t, 2, policy.Decide(3, observe(10, 0)).Replicas)
+
+	rising := observe(50, 0)
+	rising.Rising, rising.Projected = true, 120
+	assert.Equal(t, 5, policy.Decide(3, rising).Replicas, "A backlog growing past scale-up-messages should scale up")
+}
+
+func TestStepTablePolicy(t *testing.T) {
+	myConf := conf.Defaults()
+	myConf.ScalingMode = conf.StepTableScaling
+	myConf.ScaleUpSteps = "1000-10000 +1; 10000-50000 +5; 50000- =max"
+	myConf.ScaleDownSteps = "0-10 =min; 10-100 -1"
+	policy, err := NewPolicy(myConf)
+	assert.Nil(t, err)
+
+	decide := func(current int, messages int) int {
+		return policy.Decide(current, Observation{Backlog: metric.Backlog{Messages: messages}, Projected: messages, Min: 1, Max: 20}).Replicas
+	}
+	assert.Equal(t, 4, decide(3, 1000))
+	assert.Equal(t, 8, decide(3, 10000))
+	assert.Equal(t, 20, decide(3, 50000), "A band set to max should jump straight to max-pods")
+	assert.Equal(t, 3, decide(3, 500), "Between the tables the replicas should be left alone")
+	assert.Equal(t, 2, decide(3, 50))
+	assert.Equal(t, 1, decide(3, 0))
+	assert.Equal(t, 0, decide(0, 5), "A scale down band should never scale up")
+
+	rising := Observation{Backlog: metric.Backlog{Messages: 50}, Rising: true, Projected: 2000, Min: 1, Max: 20}
+	assert.Equal(t, 4, policy.Decide(3, rising).Replicas, "The projected backlog should pick the scale up band")
+
+	myConf.ScaleDownSteps = "0-10 =min; 10-2000 -1"
+	_, err = NewPolicy(myConf)
+	assert.NotNil(t, err, "Overlapping scale up and down steps should be rejected")
+
+	myConf.ScaleUpSteps, myConf.ScaleDownSteps = "", ""
+	_, err = NewPolicy(myConf)
+	assert.NotNil(t, err)
+
+	myConf.ScaleUpSteps = "1000-10000 +1; 20000- +5"
+	_, err = NewPolicy(myConf)
+	assert.NotNil(t, err, "A gap between steps should be rejected")
+}
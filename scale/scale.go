@@ -5,48 +5,128 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/monitor"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
 	"k8s.io/kubernetes/pkg/client/restclient"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
+	"math"
+	"time"
 )
 
 type KubeClient interface {
 	Deployments(namespace string) kclient.DeploymentInterface
+	Scales(namespace string) kclient.ScaleInterface
 }
 
+// PausedAnnotation on the scaled object set to "true" stops it being scaled
+// until the annotation is removed.
+const PausedAnnotation = "kube-sqs-autoscaler/paused"
+
+// updateAttempts is how many times a scale is tried when the object keeps
+// being changed by someone else between reading and writing its replicas.
+const updateAttempts = 5
+
 type PodAutoScaler struct {
-	Client            KubeClient
-	Max               int
-	Min               int
-	Deployment        string
-	Namespace         string
-	ScaleUpAmount     float64
-	ScaleDownAmount   float64
-	ScaleUpOperator   string
-	ScaleDownOperator string
-}
-
-func NewPodAutoScaler(myConf conf.MyConfType) *PodAutoScaler {
-	log.Infof("Configuring with namespace " + myConf.KubernetesNamespace)
-	config, err := restclient.InClusterConfig()
+	Client KubeClient
+	// Scaler, if set, is used to read and change the replicas instead of
+	// the scale subresource of the Deployment through Client
+	Scaler Scaler
+	// Kind is the kind of object scaled, for the events recorded about it
+	Kind Kind
+	// Annotations, if set, reads the annotations of the scaled object instead
+	// of those of the Deployment through Client
+	Annotations AnnotationReader
+	// Recorder, if set, records events about every scale
+	Recorder   Recorder
+	Max        int
+	Min        int
+	Deployment string
+	Namespace  string
+	// ScaleUpStabilization and ScaleDownStabilization are how far back the
+	// replicas decided on are looked at to limit a scale up or down
+	ScaleUpStabilization   time.Duration
+	ScaleDownStabilization time.Duration
+	// DryRun makes scales go through the whole decision without changing the
+	// replicas
+	DryRun bool
+	// Desired is the number of replicas last decided on
+	Desired int
+	// recommendations are the replicas decided on within the longest
+	// stabilization window
+	recommendations []recommendation
+	// limited is the reason of the last limit event, so it is not repeated
+	limited string
+}
+
+func NewPodAutoScaler(myConf conf.MyConfType) (*PodAutoScaler, error) {
+	log.Infof("Configuring with namespace %v", myConf.KubernetesNamespace)
+	k8sClient, err := NewKubeClient(myConf)
+	if err != nil {
+		return nil, err
+	}
+	kind, err := ParseKind(myConf.KubernetesKind)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to configure scaler")
+	}
+
+	p := &PodAutoScaler{Client: k8sClient, Kind: kind, Recorder: &KubeRecorder{Client: k8sClient}}
+	p.Configure(myConf)
+	p.Scaler = NewScaler(k8sClient, kind, myConf.KubernetesNamespace, myConf.KubernetesDeploymentName)
+	p.Annotations = NewAnnotationReader(k8sClient, kind, myConf.KubernetesNamespace, myConf.KubernetesDeploymentName)
+	return p, nil
+}
+
+// NewKubeClient returns a client for the cluster given by the kubeconfig and
+// context of myConf.
+func NewKubeClient(myConf conf.MyConfType) (*kclient.Client, error) {
+	config, err := RestConfig(myConf.Kubeconfig, myConf.KubernetesContext)
 	if err != nil {
-		panic("Failed to configure incluster config")
+		return nil, errors.Wrap(err, "Failed to configure kubernetes client")
 	}
 
 	k8sClient, err := kclient.New(config)
 	if err != nil {
-		panic("Failed to configure client")
+		return nil, errors.Wrap(err, "Failed to create kubernetes client")
 	}
-	return &PodAutoScaler{
-		Client:            k8sClient,
-		Min:               myConf.MinPods,
-		Max:               myConf.MaxPods,
-		Deployment:        myConf.KubernetesDeploymentName,
-		Namespace:         myConf.KubernetesNamespace,
-		ScaleUpAmount:     myConf.ScaleUpAmount,
-		ScaleDownAmount:   myConf.ScaleDownAmount,
-		ScaleUpOperator:   myConf.ScaleUpOperator,
-		ScaleDownOperator: myConf.ScaleDownOperator,
+	return k8sClient, nil
+}
+
+// RestConfig returns the config to reach the api server with. The kubeconfig
+// file is used if given, then the files in KUBECONFIG or ~/.kube/config, and
+// the in-cluster config if none of them are set up. context picks a context
+// other than the current one from the kubeconfig.
+func RestConfig(kubeconfig string, context string) (*restclient.Config, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+func (p *PodAutoScaler) scaler() Scaler {
+	if p.Scaler != nil {
+		return p.Scaler
 	}
+	return &ExtensionsScaler{Client: p.Client, Kind: "Deployment", Namespace: p.Namespace, Name: p.Deployment}
+}
+
+// Configure applies the scaling settings from myConf, e.g. after the config
+// has been reloaded.
+func (p *PodAutoScaler) Configure(myConf conf.MyConfType) {
+	p.Deployment = myConf.KubernetesDeploymentName
+	p.Namespace = myConf.KubernetesNamespace
+	p.ScaleUpStabilization = myConf.ScaleUpStabilization
+	p.ScaleDownStabilization = myConf.ScaleDownStabilization
+	p.DryRun = myConf.DryRun
+	p.Limit(myConf.MinPods, myConf.MaxPods)
+}
+
+// Limit sets the range replicas are kept within, e.g. for a schedule window.
+func (p *PodAutoScaler) Limit(min int, max int) {
+	p.Min = min
+	p.Max = max
+	monitor.MinReplicas.WithLabelValues(p.Namespace, p.Deployment).Set(float64(p.Min))
+	monitor.MaxReplicas.WithLabelValues(p.Namespace, p.Deployment).Set(float64(p.Max))
 }
 
 func min(a, b int) int {
@@ -70,54 +150,188 @@ const (
 	DOWN Direction = "down"
 )
 
-func (p *PodAutoScaler) Scale(direction Direction) (changed bool, err error) {
-	var newReplicas int
+// Clamp forces replicas to the permitted range of the autoscaler.
+func (p *PodAutoScaler) Clamp(replicas int) int {
+	return max(min(replicas, p.Max), p.Min)
+}
+
+// TargetReplicas returns the number of replicas needed so that each one has
+// at most messagesPerPod messages of the backlog to work through.
+func TargetReplicas(numMessages int, messagesPerPod int) int {
+	return int(math.Ceil(float64(numMessages) / float64(messagesPerPod)))
+}
+
+// Replicas returns the current number of replicas of the scaled object.
+func (p *PodAutoScaler) Replicas() (int, error) {
+	scale, err := p.getScale()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get replicas from kube server")
+	}
+	return scale.Replicas, nil
+}
+
+// Paused returns whether scaling of the object has been paused with
+// PausedAnnotation.
+func (p *PodAutoScaler) Paused() (bool, error) {
+	start := time.Now()
+	annotations, err := p.annotations()
+	monitor.ObserveRequest("kubernetes", "get_object", start, err)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to get annotations from kube server")
+	}
+	return annotations[PausedAnnotation] == "true", nil
+}
 
-	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace}).Infof("Scale " + string(direction) + " call")
+func (p *PodAutoScaler) annotations() (map[string]string, error) {
+	if p.Annotations != nil {
+		return p.Annotations.Annotations()
+	}
 	deployment, err := p.Client.Deployments(p.Namespace).Get(p.Deployment)
 	if err != nil {
-		return false, errors.Wrap(err, fmt.Sprintf("Failed to get deployment from kube server, no scale %v occured", direction))
+		return nil, err
 	}
+	return deployment.Annotations, nil
+}
+
+// ScaleWith sets the replicas to decision, which policy made from o, once it
+// is stabilized and forced to the permitted range. If the object was changed
+// while scaling the decision is made again from the fresh read of the
+// replicas. decision should already have been recorded with Stabilize, and
+// direction is the way it scales. cause is why the scale was asked for, and is
+// given in the events recorded.
+func (p *PodAutoScaler) ScaleWith(policy Policy, o Observation, decision Decision, direction Direction, cause Cause) (changed bool, err error) {
+	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace}).Infof("Scale with policy call")
+	retry := false
+	return p.update("scale", direction, cause, func(scale *Scale) int {
+		if retry {
+			decision = policy.Decide(scale.Replicas, o)
+		}
+		retry = true
+		stabilized := p.stabilized(scale.Replicas, decision.Replicas, time.Now())
+		if stabilized != decision.Replicas {
+			log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace, "recommendedReplicas": decision.Replicas, "stabilizedReplicas": stabilized}).Info("Replicas limited by recent recommendations in the stabilization window")
+		}
+		return p.limit(scale, stabilized, cause)
+	})
+}
+
+// ScaleTo sets the deployment to the given number of replicas, forced to the
+// permitted range, rather than stepping from the current count. The
+// stabilization windows are not applied, so replicas set e.g. by a schedule
+// window are not held back by recommendations from before it.
+func (p *PodAutoScaler) ScaleTo(replicas int, cause Cause) (changed bool, err error) {
+	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace, "targetReplicas": replicas}).Infof("Scale to call")
+	return p.update(fmt.Sprintf("scale to %v replicas", replicas), "", cause, func(scale *Scale) int {
+		return p.limit(scale, replicas, cause)
+	})
+}
 
-	currentReplicas := int(deployment.Spec.Replicas)
+// ScaleToZero sets the replicas to 0, below Min, once a target has been idle.
+func (p *PodAutoScaler) ScaleToZero(cause Cause) (changed bool, err error) {
+	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace}).Infof("Scale to zero call")
+	return p.update("scale to zero", DOWN, cause, func(*Scale) int {
+		return 0
+	})
+}
+
+// Activate scales a target at zero straight to replicas, forced to at most
+// Max. The stabilization windows are not applied, as the recommendations they
+// hold are from before the target was scaled to zero.
+func (p *PodAutoScaler) Activate(replicas int, cause Cause) (changed bool, err error) {
+	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace, "activationReplicas": replicas}).Infof("Activate call")
+	return p.update(fmt.Sprintf("activation to %v replicas", replicas), UP, cause, func(*Scale) int {
+		return min(replicas, p.Max)
+	})
+}
 
-	if direction == UP {
-		switch p.ScaleUpOperator {
-		case "*":
-			newReplicas = int(float64(currentReplicas) * p.ScaleUpAmount)
-		case "+":
-			newReplicas = int(float64(currentReplicas) + p.ScaleUpAmount)
-		case "-":
-			newReplicas = int(float64(currentReplicas) - p.ScaleUpAmount)
-		case "/":
-			newReplicas = int(float64(currentReplicas) / p.ScaleUpAmount)
+// limit forces wanted to the permitted range, recording an event if it was
+// limited by it.
+func (p *PodAutoScaler) limit(scale *Scale, wanted int, cause Cause) int {
+	clamped := p.Clamp(wanted) // Force to permitted range
+	p.recordLimit(scale, wanted, clamped, cause)
+	return clamped
+}
+
+// getScale reads the scale of the object, recording the replicas found.
+func (p *PodAutoScaler) getScale() (*Scale, error) {
+	start := time.Now()
+	scale, err := p.scaler().GetScale()
+	monitor.ObserveRequest("kubernetes", "get_scale", start, err)
+	if err != nil {
+		return nil, err
+	}
+	monitor.Replicas.WithLabelValues(p.Namespace, p.Deployment).Set(float64(scale.Replicas))
+	return scale, nil
+}
+
+// update reads the current scale, works out the new replicas from it and
+// writes them back. If the object was changed in between, the write is
+// rejected with a conflict and the whole read-modify-write is retried against
+// a fresh read, up to updateAttempts times. If direction is empty it is taken
+// from how the replicas change.
+func (p *PodAutoScaler) update(action string, direction Direction, cause Cause, replicas func(scale *Scale) int) (changed bool, err error) {
+	for attempt := 1; ; attempt++ {
+		scale, err := p.getScale()
+		if err != nil {
+			return false, errors.Wrap(err, fmt.Sprintf("Failed to get replicas from kube server, no %v occured", action))
 		}
-	} else {
-		switch p.ScaleDownOperator {
-		case "*":
-			newReplicas = int(float64(currentReplicas) * p.ScaleDownAmount)
-		case "+":
-			newReplicas = int(float64(currentReplicas) + p.ScaleDownAmount)
-		case "-":
-			newReplicas = int(float64(currentReplicas) - p.ScaleDownAmount)
-		case "/":
-			newReplicas = int(float64(currentReplicas) / p.ScaleDownAmount)
+
+		newReplicas := replicas(scale)
+		scaleDirection := direction
+		if scaleDirection == "" {
+			scaleDirection = UP
+			if newReplicas < scale.Replicas {
+				scaleDirection = DOWN
+			}
 		}
+		p.Desired = newReplicas
+		monitor.DesiredReplicas.WithLabelValues(p.Namespace, p.Deployment).Set(float64(newReplicas))
+
+		currentReplicas := scale.Replicas
+		changed, err = p.setReplicas(scale, newReplicas, scaleDirection)
+		if err == nil || !apierrors.IsConflict(errors.Cause(err)) || attempt >= updateAttempts {
+			result := "success"
+			if err != nil {
+				result = "error"
+			} else if !changed {
+				result = "unchanged"
+			} else if p.DryRun {
+				result = "dry_run"
+			}
+			monitor.Scales.WithLabelValues(p.Namespace, p.Deployment, string(scaleDirection), result).Inc()
+			p.recordScale(scale, currentReplicas, newReplicas, scaleDirection, cause, changed, err)
+			return changed, err
+		}
+		log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace, "attempt": attempt}).Warn("Replicas changed while scaling, retrying")
 	}
-	newReplicas = max(min(newReplicas, p.Max), p.Min) // Force to permitted range
+}
+
+// setReplicas changes the replicas of scale to newReplicas, returning whether
+// they changed. In a dry run nothing is written but the replicas are reported
+// as changed, so the caller goes on as if they had.
+func (p *PodAutoScaler) setReplicas(scale *Scale, newReplicas int, direction Direction) (changed bool, err error) {
+	currentReplicas := scale.Replicas
 	if newReplicas == currentReplicas {
 		log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace, "maxPods": p.Max, "minPods": p.Min, "currentReplicas": currentReplicas}).Info("Target replicas = currentReplicas, no change needed")
 		return false, nil
 	}
 
-	deployment.Spec.Replicas = int32(newReplicas)
+	if p.DryRun {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "Namespace": p.Namespace, "currentReplicas": currentReplicas, "newReplicas": newReplicas}).Infof("Dry run, would scale %v", direction)
+		return true, nil
+	}
+
+	scale.Replicas = newReplicas
 
 	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "newReplicas": newReplicas}).Infof("SetReplicas call")
-	_, err = p.Client.Deployments(p.Namespace).Update(deployment)
+	start := time.Now()
+	err = p.scaler().UpdateScale(scale)
+	monitor.ObserveRequest("kubernetes", "update_scale", start, err)
 	if err != nil {
 		return false, errors.Wrap(err, "Failed to scale "+string(direction))
 	}
+	monitor.Replicas.WithLabelValues(p.Namespace, p.Deployment).Set(float64(newReplicas))
 
-	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "newReplicas": newReplicas}).Infof("Scale " + string(direction) + " successful")
+	log.WithFields(log.Fields{"kubernetesDeploymentName": p.Deployment, "newReplicas": newReplicas}).Infof("Scale %v successful", direction)
 	return true, nil
 }
@@ -1,31 +1,69 @@
 package scale
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
+	"github.com/uswitch/kube-sqs-autoscaler/monitor"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
+	dto "github.com/prometheus/client_model/go"
 	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
 	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/client/restclient"
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 	"k8s.io/kubernetes/pkg/watch"
 )
 
+// stepScale scales p with a StepPolicy stepping by 1, observing a backlog past
+// the threshold for direction.
+func stepScale(p *PodAutoScaler, direction Direction, cause Cause) (bool, error) {
+	myConf := conf.Defaults()
+	myConf.ScaleUpMessages, myConf.ScaleDownMessages = 1000, 10
+	myConf.ScaleUpOperator, myConf.ScaleUpAmount = "+", 1
+	myConf.ScaleDownOperator, myConf.ScaleDownAmount = "-", 1
+	policy, _ := NewStepPolicy(myConf)
+
+	messages := 0
+	if direction == UP {
+		messages = 1200
+	}
+	o := Observation{Backlog: metric.Backlog{Messages: messages}, Projected: messages}
+	// decide from the deployment, as a poll would have read it before scaling
+	deployment, _ := p.Client.Deployments(p.Namespace).Get(p.Deployment)
+	return p.ScaleWith(policy, o, policy.Decide(int(deployment.Spec.Replicas), o), direction, cause)
+}
+
 func TestScaleUp(t *testing.T) {
 	p := NewMockPodAutoScaler("test", "test", 5, 1)
 
 	// Scale up replicas until we reach the max (5).
-	// Scale up again and assert that we get an error back when trying to scale up replicas pass the max
-	err := p.ScaleUp()
+	// Scale up again and assert that replicas are not changed past the max
+	changed, err := stepScale(p, UP, Cause{})
 	deployment, _ := p.Client.Deployments("test").Get("test")
 	assert.Nil(t, err)
+	assert.True(t, changed)
 	assert.Equal(t, int32(4), deployment.Spec.Replicas)
-	err = p.ScaleUp()
+	changed, err = stepScale(p, UP, Cause{})
 	assert.Nil(t, err)
+	assert.True(t, changed)
 	deployment, _ = p.Client.Deployments("test").Get("test")
 	assert.Equal(t, int32(5), deployment.Spec.Replicas)
 
-	err = p.ScaleUp()
-	assert.NotNil(t, err)
+	changed, err = stepScale(p, UP, Cause{})
+	assert.Nil(t, err)
+	assert.False(t, changed)
 	deployment, _ = p.Client.Deployments("test").Get("test")
 	assert.Equal(t, int32(5), deployment.Spec.Replicas)
 }
@@ -33,19 +71,290 @@ func TestScaleUp(t *testing.T) {
 func TestScaleDown(t *testing.T) {
 	p := NewMockPodAutoScaler("test", "test", 5, 1)
 
-	err := p.ScaleDown()
+	changed, err := stepScale(p, DOWN, Cause{})
 	assert.Nil(t, err)
+	assert.True(t, changed)
 	deployment, _ := p.Client.Deployments("test").Get("test")
 	assert.Equal(t, int32(2), deployment.Spec.Replicas)
-	err = p.ScaleDown()
+	changed, err = stepScale(p, DOWN, Cause{})
 	assert.Nil(t, err)
+	assert.True(t, changed)
 	deployment, _ = p.Client.Deployments("test").Get("test")
 	assert.Equal(t, int32(1), deployment.Spec.Replicas)
 
-	err = p.ScaleDown()
-	assert.NotNil(t, err)
+	held := scaleCount(p, DOWN, "unchanged")
+	changed, err = stepScale(p, DOWN, Cause{})
+	assert.Nil(t, err)
+	assert.False(t, changed)
 	deployment, _ = p.Client.Deployments("test").Get("test")
 	assert.Equal(t, int32(1), deployment.Spec.Replicas)
+	assert.Equal(t, held+1, scaleCount(p, DOWN, "unchanged"), "A scale down held at the min should be counted as a scale down")
+}
+
+// scaleCount returns the scales of p counted in direction with result.
+func scaleCount(p *PodAutoScaler, direction Direction, result string) float64 {
+	var m dto.Metric
+	monitor.Scales.WithLabelValues(p.Namespace, p.Deployment, string(direction), result).Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func TestScaleTo(t *testing.T) {
+	p := NewMockPodAutoScaler("test", "test", 5, 1)
+
+	changed, err := p.ScaleTo(5, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	deployment, _ := p.Client.Deployments("test").Get("test")
+	assert.Equal(t, int32(5), deployment.Spec.Replicas)
+
+	changed, err = p.ScaleTo(50, Cause{})
+	assert.Nil(t, err)
+	assert.False(t, changed, "Replicas should be held at the max")
+
+	changed, err = p.ScaleTo(0, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	deployment, _ = p.Client.Deployments("test").Get("test")
+	assert.Equal(t, int32(1), deployment.Spec.Replicas, "Replicas should be held at the min")
+}
+
+func TestScaleRetriesConflicts(t *testing.T) {
+	p := NewMockPodAutoScaler("test", "test", 5, 1)
+	client := p.Client.(*MockKubeClient)
+	client.Conflicts = 2
+
+	policy := &countingPolicy{}
+	changed, err := p.ScaleWith(policy, Observation{}, Decision{Replicas: 4}, UP, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 3, client.Updates, "The scale should be retried with a fresh read after each conflict")
+	assert.Equal(t, 2, policy.decisions, "The decision should only be made again after a conflict")
+	assert.Equal(t, int32(4), client.Deployment.Spec.Replicas)
+
+	client.Conflicts = updateAttempts
+	client.Updates = 0
+	changed, err = p.ScaleTo(1, Cause{})
+	assert.NotNil(t, err)
+	assert.True(t, apierrors.IsConflict(errors.Cause(err)))
+	assert.False(t, changed)
+	assert.Equal(t, updateAttempts, client.Updates, "The number of attempts should be bounded")
+	assert.Equal(t, int32(4), client.Deployment.Spec.Replicas)
+}
+
+// countingPolicy wants one more replica than current, counting its decisions.
+type countingPolicy struct {
+	decisions int
+}
+
+func (p *countingPolicy) Decide(current int, o Observation) Decision {
+	p.decisions++
+	return Decision{Replicas: current + 1}
+}
+
+func TestNewPodAutoScalerFromKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubeconfig")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "config")
+	ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+current-context: local
+clusters:
+- name: local
+  cluster:
+    server: https://localhost:6443
+- name: remote
+  cluster:
+    server: https://remote.example.com
+users:
+- name: admin
+  user:
+    token: secret
+contexts:
+- name: local
+  context:
+    cluster: local
+    user: admin
+- name: remote
+  context:
+    cluster: remote
+    user: admin
+`), 0600)
+
+	config, err := RestConfig(kubeconfig, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://localhost:6443", config.Host)
+	assert.Equal(t, "secret", config.BearerToken)
+
+	config, err = RestConfig(kubeconfig, "remote")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://remote.example.com", config.Host)
+
+	_, err = RestConfig(kubeconfig, "missing")
+	assert.NotNil(t, err)
+
+	myConf := conf.MyConfType{KubernetesDeploymentName: "test", KubernetesNamespace: "test", Kubeconfig: kubeconfig, MaxPods: 5, MinPods: 1}
+	p, err := NewPodAutoScaler(myConf)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", p.Deployment)
+
+	myConf.KubernetesKind = "Pod"
+	_, err = NewPodAutoScaler(myConf)
+	assert.NotNil(t, err, "A bad kind should be returned as an error")
+
+	myConf.KubernetesKind = ""
+	myConf.Kubeconfig = filepath.Join(dir, "missing")
+	_, err = NewPodAutoScaler(myConf)
+	assert.NotNil(t, err, "A missing kubeconfig should be returned as an error")
+}
+
+func TestScaleRecordsEvents(t *testing.T) {
+	p := NewMockPodAutoScaler("test", "test", 5, 1)
+	recorder := &MockRecorder{}
+	p.Recorder = recorder
+	cause := Cause{Messages: 1200, Reason: "at or above scale-up-messages 1000"}
+
+	stepScale(p, UP, cause)
+	stepScale(p, UP, cause)
+	stepScale(p, UP, cause)
+	stepScale(p, UP, cause)
+	assert.Equal(t, []string{
+		"Normal ScaledUp Deployment test/test: Scaled up from 3 to 4 replicas: 1200 messages, at or above scale-up-messages 1000",
+		"Normal ScaledUp Deployment test/test: Scaled up from 4 to 5 replicas: 1200 messages, at or above scale-up-messages 1000",
+		"Warning ReplicasAtMax Deployment test/test: Wanted 6 replicas but limited to max-pods 5: 1200 messages, at or above scale-up-messages 1000",
+	}, recorder.Events, "Hitting the max should only be recorded once")
+
+	recorder.Events = nil
+	p.Client.(*MockKubeClient).Conflicts = updateAttempts
+	p.ScaleTo(2, Cause{Messages: 150, Reason: "target-messages-per-pod 100"})
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, recorder.Events[0], "Warning FailedScale Deployment test/test: Failed to scale down from 5 to 2 replicas (150 messages, target-messages-per-pod 100): ")
+}
+
+func TestScaleDryRun(t *testing.T) {
+	p := NewMockPodAutoScaler("test", "test", 5, 1)
+	p.DryRun = true
+	recorder := &MockRecorder{}
+	p.Recorder = recorder
+	client := p.Client.(*MockKubeClient)
+
+	changed, err := stepScale(p, UP, Cause{Messages: 1200, Reason: "at or above scale-up-messages 1000"})
+	assert.Nil(t, err)
+	assert.True(t, changed, "A dry run should report the scale it would have made")
+	assert.Equal(t, 4, p.Desired)
+	assert.Equal(t, 0, client.Updates, "A dry run should not write the replicas")
+	assert.Equal(t, int32(3), client.Deployment.Spec.Replicas)
+	assert.Equal(t, []string{
+		"Normal WouldScaleUp Deployment test/test: Dry run, would have scaled up from 3 to 4 replicas: 1200 messages, at or above scale-up-messages 1000",
+	}, recorder.Events)
+
+	changed, err = p.ScaleTo(3, Cause{})
+	assert.Nil(t, err)
+	assert.False(t, changed, "Replicas already at the target should not be reported as a scale")
+}
+
+func TestKubeRecorder(t *testing.T) {
+	var event map[string]interface{}
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.Method + " " + r.URL.Path
+		json.NewDecoder(r.Body).Decode(&event)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(event)
+	}))
+	defer server.Close()
+
+	client, err := kclient.New(&restclient.Config{Host: server.URL})
+	assert.Nil(t, err)
+	recorder := &KubeRecorder{Client: client}
+	recorder.Event(api.ObjectReference{Kind: "Deployment", Name: "worker", Namespace: "test", UID: "1234"}, api.EventTypeNormal, "ScaledUp", "Scaled up from 3 to 4 replicas")
+
+	assert.Equal(t, "POST /api/v1/namespaces/test/events", path)
+	assert.Equal(t, "ScaledUp", event["reason"])
+	assert.Equal(t, "Normal", event["type"])
+	assert.Equal(t, map[string]interface{}{"kind": "Deployment", "name": "worker", "namespace": "test", "uid": "1234"}, event["involvedObject"])
+	assert.Equal(t, map[string]interface{}{"component": "kube-sqs-autoscaler"}, event["source"])
+}
+
+func TestScaleStabilization(t *testing.T) {
+	p := NewMockPodAutoScaler("test", "test", 10, 1)
+	p.ScaleDownStabilization = time.Minute
+
+	assert.Equal(t, 6, p.Stabilize(3, 6))
+	changed, err := p.ScaleWith(fixedPolicy{replicas: 6}, Observation{}, Decision{Replicas: 6}, UP, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 6, p.Stabilize(6, 2))
+	changed, err = p.ScaleWith(fixedPolicy{replicas: 2}, Observation{}, Decision{Replicas: 2}, DOWN, Cause{})
+	assert.Nil(t, err)
+	assert.False(t, changed, "A scale down below a recent recommendation should be held back")
+	assert.Equal(t, 6, p.Desired)
+	assert.Len(t, p.recommendations, 2, "Scaling should not record the decision again")
+
+	p.Limit(1, 4)
+	changed, err = p.ScaleWith(fixedPolicy{replicas: 2}, Observation{}, Decision{Replicas: 2}, DOWN, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	deployment, _ := p.Client.Deployments("test").Get("test")
+	assert.Equal(t, int32(4), deployment.Spec.Replicas, "The stabilized replicas should still be forced within the limits")
+
+	p.Limit(1, 10)
+	changed, err = p.ScaleTo(8, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	changed, err = p.ScaleTo(3, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed, "Scaling to set replicas should not be held back by the stabilization window")
+
+	// age the recommendations past the window
+	for i := range p.recommendations {
+		p.recommendations[i].time = p.recommendations[i].time.Add(-2 * time.Minute)
+	}
+	assert.Equal(t, 2, p.Stabilize(3, 2))
+	changed, err = p.ScaleWith(fixedPolicy{replicas: 2}, Observation{}, Decision{Replicas: 2}, DOWN, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	deployment, _ = p.Client.Deployments("test").Get("test")
+	assert.Equal(t, int32(2), deployment.Spec.Replicas)
+}
+
+func TestStabilize(t *testing.T) {
+	p := NewMockPodAutoScaler("test", "test", 10, 1)
+	now := time.Now()
+	assert.Equal(t, 7, p.stabilize(3, 7, now), "Without windows the recommendation should be used as is")
+
+	p.ScaleUpStabilization = time.Minute
+	p.ScaleDownStabilization = 5 * time.Minute
+	recent := []recommendation{
+		{time: now.Add(-10 * time.Minute), replicas: 9},
+		{time: now.Add(-4 * time.Minute), replicas: 6},
+		{time: now.Add(-30 * time.Second), replicas: 4},
+	}
+	p.recommendations = append([]recommendation{}, recent...)
+	assert.Equal(t, 4, p.stabilize(3, 8, now), "A scale up should go no higher than the lowest recommendation in the scale up window")
+	assert.Len(t, p.recommendations, 3, "Recommendations older than the longest window should be dropped")
+
+	p.recommendations = append([]recommendation{}, recent...)
+	assert.Equal(t, 6, p.stabilize(8, 2, now), "A scale down should go no lower than the highest recommendation in the scale down window")
+	p.recommendations = append([]recommendation{}, recent...)
+	assert.Equal(t, 5, p.stabilize(5, 2, now), "Stabilizing a scale down should never scale up")
+}
+
+func TestTargetReplicas(t *testing.T) {
+	assert.Equal(t, 0, TargetReplicas(0, 100))
+	assert.Equal(t, 1, TargetReplicas(1, 100))
+	assert.Equal(t, 1, TargetReplicas(100, 100))
+	assert.Equal(t, 2, TargetReplicas(101, 100))
+	assert.Equal(t, 35, TargetReplicas(3456, 100))
+}
+
+type MockRecorder struct {
+	Events []string
+}
+
+func (m *MockRecorder) Event(object api.ObjectReference, eventType string, reason string, message string) {
+	m.Events = append(m.Events, fmt.Sprintf("%v %v %v %v/%v: %v", eventType, reason, object.Kind, object.Namespace, object.Name, message))
 }
 
 type MockDeployment struct {
@@ -55,6 +364,10 @@ type MockDeployment struct {
 type MockKubeClient struct {
 	// stores the state of Deployment as if the api server did
 	Deployment *extensions.Deployment
+	// Conflicts is the number of scale updates to reject with a conflict
+	Conflicts int
+	// Updates counts the scale updates tried
+	Updates int
 }
 
 func (m *MockDeployment) Get(name string) (*extensions.Deployment, error) {
@@ -96,6 +409,43 @@ func (m *MockKubeClient) Deployments(namespace string) kclient.DeploymentInterfa
 	}
 }
 
+type MockScale struct {
+	client *MockKubeClient
+}
+
+// Get returns the scale of the Deployment held by the mock client.
+func (m *MockScale) Get(kind string, name string) (*extensions.Scale, error) {
+	deployment := m.client.Deployment
+	return &extensions.Scale{
+		ObjectMeta: api.ObjectMeta{Name: name, ResourceVersion: deployment.ResourceVersion},
+		Spec:       extensions.ScaleSpec{Replicas: deployment.Spec.Replicas},
+	}, nil
+}
+
+// Update writes the replicas to the Deployment held by the mock client unless
+// the scale was read at an older resourceVersion. Conflicts makes that many
+// updates fail as if someone else had changed the Deployment in between.
+func (m *MockScale) Update(kind string, scale *extensions.Scale) (*extensions.Scale, error) {
+	deployment := m.client.Deployment
+	m.client.Updates++
+	if m.client.Conflicts > 0 {
+		m.client.Conflicts--
+		deployment.ResourceVersion = strconv.Itoa(m.client.Updates) + "-other"
+	}
+	if scale.ResourceVersion != deployment.ResourceVersion {
+		return nil, apierrors.NewConflict(extensions.Resource("deployments"), scale.Name, fmt.Errorf("the object has been modified"))
+	}
+	deployment.Spec.Replicas = scale.Spec.Replicas
+	deployment.ResourceVersion = strconv.Itoa(m.client.Updates)
+	return scale, nil
+}
+
+func (m *MockKubeClient) Scales(namespace string) kclient.ScaleInterface {
+	return &MockScale{
+		client: m,
+	}
+}
+
 func NewMockKubeClient() *MockKubeClient {
 	return &MockKubeClient{
 		Deployment: &extensions.Deployment{
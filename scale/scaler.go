@@ -0,0 +1,220 @@
+package scale
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/kubernetes/pkg/apis/extensions"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/types"
+)
+
+// Scale is the replica count of a scaled object, as read by a Scaler.
+type Scale struct {
+	Replicas        int
+	ResourceVersion string
+	// UID is the uid of the scaled object, for events to refer to it
+	UID types.UID
+	// Object is what the scale was read from, for the Scaler to write back
+	Object interface{}
+}
+
+// Scaler reads and changes the replicas of the object being scaled, e.g. a
+// Deployment. UpdateScale must fail with a conflict if the object has changed
+// since the scale was read.
+type Scaler interface {
+	GetScale() (*Scale, error)
+	UpdateScale(scale *Scale) error
+}
+
+// ScaleClient is the part of the kubernetes client used to scale Deployments
+// and ReplicaSets.
+type ScaleClient interface {
+	Scales(namespace string) kclient.ScaleInterface
+}
+
+// Kind is the type of object a Scaler works on.
+type Kind struct {
+	// Name is the resource, e.g. deployments, or Deployment or ReplicaSet
+	// for a Kind without a Path, scaled through the extensions api
+	Name string
+	// Path is the api path of the resource's group and version
+	Path string
+	// ObjectKind is the kind of the objects of the resource, if known
+	ObjectKind string
+}
+
+// ParseKind returns the Kind for a kubernetes-kind setting: Deployment, the
+// default when empty, ReplicaSet, StatefulSet, or group/version/resource for
+// any object with a scale subresource, e.g. argoproj.io/v1alpha1/rollouts, or
+// v1/resource for the core group. Deployments, ReplicaSets and StatefulSets
+// are all scaled through the apps/v1 api.
+func ParseKind(kind string) (Kind, error) {
+	switch strings.ToLower(kind) {
+	case "", "deployment", "deployments":
+		return Kind{Name: "deployments", Path: "/apis/apps/v1", ObjectKind: "Deployment"}, nil
+	case "replicaset", "replicasets":
+		return Kind{Name: "replicasets", Path: "/apis/apps/v1", ObjectKind: "ReplicaSet"}, nil
+	case "statefulset", "statefulsets":
+		return Kind{Name: "statefulsets", Path: "/apis/apps/v1", ObjectKind: "StatefulSet"}, nil
+	}
+
+	parts := strings.Split(kind, "/")
+	for _, part := range parts {
+		if part == "" {
+			return Kind{}, errors.Errorf("kubernetes-kind %q has an empty part", kind)
+		}
+	}
+	switch len(parts) {
+	case 2:
+		return Kind{Name: parts[1], Path: "/api/" + parts[0]}, nil
+	case 3:
+		return Kind{Name: parts[2], Path: "/apis/" + parts[0] + "/" + parts[1]}, nil
+	}
+	return Kind{}, errors.Errorf("kubernetes-kind %q is not Deployment, ReplicaSet, StatefulSet or group/version/resource", kind)
+}
+
+// objectPath returns the api path of the object of this kind.
+func (k Kind) objectPath(namespace string, name string) string {
+	if k.Path == "" {
+		return fmt.Sprintf("/apis/extensions/v1beta1/namespaces/%v/%vs/%v", namespace, strings.ToLower(k.Name), name)
+	}
+	return fmt.Sprintf("%v/namespaces/%v/%v/%v", k.Path, namespace, k.Name, name)
+}
+
+// AnnotationReader reads the annotations of the scaled object.
+type AnnotationReader interface {
+	Annotations() (map[string]string, error)
+}
+
+// ObjectAnnotations reads the annotations of the object at Path as plain JSON,
+// so it works for any kind. The scale subresource is not used since it does
+// not carry the annotations of its object.
+type ObjectAnnotations struct {
+	Client *restclient.RESTClient
+	Path   string
+}
+
+// NewAnnotationReader returns the AnnotationReader for the object of the
+// given kind.
+func NewAnnotationReader(client *kclient.Client, kind Kind, namespace string, name string) AnnotationReader {
+	return &ObjectAnnotations{Client: client.RESTClient, Path: kind.objectPath(namespace, name)}
+}
+
+func (o *ObjectAnnotations) Annotations() (map[string]string, error) {
+	body, err := o.Client.Get().AbsPath(o.Path).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var object struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode %v", o.Path)
+	}
+	return object.Metadata.Annotations, nil
+}
+
+// NewScaler returns the Scaler for the object of the given kind.
+func NewScaler(client *kclient.Client, kind Kind, namespace string, name string) Scaler {
+	switch {
+	case kind.Path != "":
+		return &SubresourceScaler{Client: client.RESTClient, Path: kind.Path, Resource: kind.Name, Namespace: namespace, Name: name}
+	}
+	return &ExtensionsScaler{Client: client, Kind: kind.Name, Namespace: namespace, Name: name}
+}
+
+// ExtensionsScaler scales a Deployment or ReplicaSet through the scale
+// subresource of the extensions api, so only the replica count is written and
+// edits made to the rest of the object in the meantime are left alone. It is
+// only used by a PodAutoScaler with no Scaler set, since every Kind from
+// ParseKind has a Path and is scaled by a SubresourceScaler.
+type ExtensionsScaler struct {
+	Client ScaleClient
+	// Kind is Deployment or ReplicaSet
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func (e *ExtensionsScaler) GetScale() (*Scale, error) {
+	scale, err := e.Client.Scales(e.Namespace).Get(e.Kind, e.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &Scale{Replicas: int(scale.Spec.Replicas), ResourceVersion: scale.ResourceVersion, UID: scale.UID, Object: scale}, nil
+}
+
+// UpdateScale writes the scale back with the resourceVersion it was read at,
+// so the api server rejects it with a conflict if the replicas changed since.
+func (e *ExtensionsScaler) UpdateScale(scale *Scale) error {
+	object := scale.Object.(*extensions.Scale)
+	object.Spec.Replicas = int32(scale.Replicas)
+	_, err := e.Client.Scales(e.Namespace).Update(e.Kind, object)
+	return err
+}
+
+// SubresourceScaler scales any object through its scale subresource, e.g.
+// StatefulSets or custom resources such as Argo Rollouts. The scale is handled
+// as plain JSON so it works with whichever version of Scale the api server
+// returns.
+type SubresourceScaler struct {
+	Client *restclient.RESTClient
+	// Path is the api path of the resource's group and version, e.g. /apis/apps/v1
+	Path      string
+	Resource  string
+	Namespace string
+	Name      string
+}
+
+func (s *SubresourceScaler) path() string {
+	return fmt.Sprintf("%v/namespaces/%v/%v/%v/scale", s.Path, s.Namespace, s.Resource, s.Name)
+}
+
+func (s *SubresourceScaler) GetScale() (*Scale, error) {
+	body, err := s.Client.Get().AbsPath(s.path()).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode scale of %v %v", s.Resource, s.Name)
+	}
+
+	scale := &Scale{Object: object}
+	if spec, ok := object["spec"].(map[string]interface{}); ok {
+		if replicas, ok := spec["replicas"].(float64); ok {
+			scale.Replicas = int(replicas)
+		}
+	}
+	if metadata, ok := object["metadata"].(map[string]interface{}); ok {
+		scale.ResourceVersion, _ = metadata["resourceVersion"].(string)
+		uid, _ := metadata["uid"].(string)
+		scale.UID = types.UID(uid)
+	}
+	return scale, nil
+}
+
+func (s *SubresourceScaler) UpdateScale(scale *Scale) error {
+	object := scale.Object.(map[string]interface{})
+	spec, ok := object["spec"].(map[string]interface{})
+	if !ok {
+		spec = map[string]interface{}{}
+		object["spec"] = spec
+	}
+	spec["replicas"] = scale.Replicas
+
+	body, err := json.Marshal(object)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to encode scale of %v %v", s.Resource, s.Name)
+	}
+	_, err = s.Client.Put().AbsPath(s.path()).SetHeader("Content-Type", "application/json").Body(body).DoRaw()
+	return err
+}
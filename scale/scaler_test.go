@@ -0,0 +1,156 @@
+package scale
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+func TestParseKind(t *testing.T) {
+	for kind, expected := range map[string]Kind{
+		"":                              {Name: "deployments", Path: "/apis/apps/v1", ObjectKind: "Deployment"},
+		"Deployment":                    {Name: "deployments", Path: "/apis/apps/v1", ObjectKind: "Deployment"},
+		"replicaset":                    {Name: "replicasets", Path: "/apis/apps/v1", ObjectKind: "ReplicaSet"},
+		"StatefulSet":                   {Name: "statefulsets", Path: "/apis/apps/v1", ObjectKind: "StatefulSet"},
+		"argoproj.io/v1alpha1/rollouts": {Name: "rollouts", Path: "/apis/argoproj.io/v1alpha1"},
+		"v1/replicationcontrollers":     {Name: "replicationcontrollers", Path: "/api/v1"},
+	} {
+		parsed, err := ParseKind(kind)
+		assert.Nil(t, err, kind)
+		assert.Equal(t, expected, parsed, kind)
+	}
+
+	for _, kind := range []string{"Pod", "a/b/c/d", "argoproj.io//rollouts"} {
+		_, err := ParseKind(kind)
+		assert.NotNil(t, err, kind)
+	}
+}
+
+func TestScaleReplicaSet(t *testing.T) {
+	replicas, resourceVersion := 3, 1
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == "PUT" {
+			var scale map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&scale)
+			if scale["metadata"].(map[string]interface{})["resourceVersion"] != strconv.Itoa(resourceVersion) {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Conflict", "code": http.StatusConflict})
+				return
+			}
+			replicas = int(scale["spec"].(map[string]interface{})["replicas"].(float64))
+			resourceVersion++
+		} else if len(requests) == 1 {
+			// someone else changes the ReplicaSet after the first read
+			defer func() { replicas, resourceVersion = 4, resourceVersion+1 }()
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"kind":       "Scale",
+			"apiVersion": "autoscaling/v1",
+			"metadata":   map[string]interface{}{"name": "test", "namespace": "test", "resourceVersion": strconv.Itoa(resourceVersion)},
+			"spec":       map[string]interface{}{"replicas": replicas},
+		})
+	}))
+	defer server.Close()
+
+	client, err := kclient.New(&restclient.Config{Host: server.URL})
+	assert.Nil(t, err)
+	kind, _ := ParseKind("ReplicaSet")
+	p := NewMockPodAutoScaler("test", "test", 10, 1)
+	p.Scaler = NewScaler(client, kind, "test", "test")
+
+	changed, err := stepScale(p, UP, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	path := "/apis/apps/v1/namespaces/test/replicasets/test/scale"
+	assert.Equal(t, []string{"GET " + path, "PUT " + path, "GET " + path, "PUT " + path}, requests)
+	assert.Equal(t, 5, replicas, "The scale up should be worked out again from the replicas set by someone else")
+
+	deployment, _ := p.Client.Deployments("test").Get("test")
+	assert.Equal(t, int32(3), deployment.Spec.Replicas, "The deployment should not be scaled when a scaler is set")
+}
+
+func TestScaleSubresource(t *testing.T) {
+	scale := map[string]interface{}{
+		"kind":       "Scale",
+		"apiVersion": "autoscaling/v1",
+		"metadata":   map[string]interface{}{"name": "test", "namespace": "test", "resourceVersion": "42"},
+		"spec":       map[string]interface{}{"replicas": 3},
+		"status":     map[string]interface{}{"replicas": 3, "selector": "app=test"},
+	}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == "PUT" {
+			body, _ := ioutil.ReadAll(r.Body)
+			json.Unmarshal(body, &scale)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scale)
+	}))
+	defer server.Close()
+
+	client, err := kclient.New(&restclient.Config{Host: server.URL})
+	assert.Nil(t, err)
+	kind, _ := ParseKind("StatefulSet")
+	p := NewMockPodAutoScaler("test", "test", 5, 1)
+	p.Scaler = NewScaler(client, kind, "test", "test")
+
+	changed, err := p.ScaleTo(5, Cause{})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{
+		"GET /apis/apps/v1/namespaces/test/statefulsets/test/scale",
+		"PUT /apis/apps/v1/namespaces/test/statefulsets/test/scale",
+	}, requests)
+	assert.Equal(t, 5.0, scale["spec"].(map[string]interface{})["replicas"])
+	assert.Equal(t, "app=test", scale["status"].(map[string]interface{})["selector"], "Fields of the scale not known to the scaler should be kept")
+
+	replicas, err := p.Replicas()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, replicas)
+}
+
+func TestPausedAnnotation(t *testing.T) {
+	annotations := map[string]interface{}{}
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "test", "annotations": annotations},
+		})
+	}))
+	defer server.Close()
+
+	client, err := kclient.New(&restclient.Config{Host: server.URL})
+	assert.Nil(t, err)
+	replicaSet, _ := ParseKind("ReplicaSet")
+	statefulSet, _ := ParseKind("StatefulSet")
+	p := NewMockPodAutoScaler("test", "test", 5, 1)
+
+	p.Annotations = NewAnnotationReader(client, replicaSet, "test", "test")
+	paused, err := p.Paused()
+	assert.Nil(t, err)
+	assert.False(t, paused)
+
+	annotations[PausedAnnotation] = "true"
+	p.Annotations = NewAnnotationReader(client, statefulSet, "test", "test")
+	paused, err = p.Paused()
+	assert.Nil(t, err)
+	assert.True(t, paused)
+
+	assert.Equal(t, []string{
+		"GET /apis/apps/v1/namespaces/test/replicasets/test",
+		"GET /apis/apps/v1/namespaces/test/statefulsets/test",
+	}, requests)
+}
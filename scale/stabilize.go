@@ -0,0 +1,69 @@
+package scale
+
+import (
+	"time"
+)
+
+// recommendation is a number of replicas decided on and when.
+type recommendation struct {
+	time     time.Time
+	replicas int
+}
+
+// Stabilize records replicas as the latest recommendation and returns the
+// replicas to scale to from currentReplicas. It is called once on every poll,
+// whether or not a scale follows, so a steady number of replicas holds back a
+// later noisy scale down. replicas is the decision of the policy before it is
+// forced to the permitted range, which is done to the stabilized replicas so
+// the limits always hold.
+func (p *PodAutoScaler) Stabilize(currentReplicas int, replicas int) int {
+	return p.stabilize(currentReplicas, replicas, time.Now())
+}
+
+// stabilize records replicas as the latest recommendation, dropping those
+// older than the longest window, and returns the replicas to scale to from
+// currentReplicas.
+func (p *PodAutoScaler) stabilize(currentReplicas int, replicas int, now time.Time) int {
+	p.recommendations = append(p.recommendations, recommendation{time: now, replicas: replicas})
+
+	longest := p.ScaleUpStabilization
+	if p.ScaleDownStabilization > longest {
+		longest = p.ScaleDownStabilization
+	}
+	kept := p.recommendations[:0]
+	for _, r := range p.recommendations {
+		if now.Sub(r.time) <= longest {
+			kept = append(kept, r)
+		}
+	}
+	p.recommendations = kept
+
+	return p.stabilized(currentReplicas, replicas, now)
+}
+
+// stabilized returns the replicas to scale to from currentReplicas for
+// replicas, as the HorizontalPodAutoscaler does: a scale up goes no higher
+// than the lowest recommendation within ScaleUpStabilization, and a scale down
+// no lower than the highest within ScaleDownStabilization. With both at 0
+// replicas is returned unchanged. Nothing is recorded.
+func (p *PodAutoScaler) stabilized(currentReplicas int, replicas int, now time.Time) int {
+	upLimit, downLimit := replicas, replicas
+	for _, r := range p.recommendations {
+		age := now.Sub(r.time)
+		if age <= p.ScaleUpStabilization {
+			upLimit = min(upLimit, r.replicas)
+		}
+		if age <= p.ScaleDownStabilization {
+			downLimit = max(downLimit, r.replicas)
+		}
+	}
+
+	stabilized := currentReplicas
+	if stabilized < upLimit {
+		stabilized = upLimit
+	}
+	if stabilized > downLimit {
+		stabilized = downLimit
+	}
+	return stabilized
+}
@@ -0,0 +1,194 @@
+// Package schedule overrides the replica limits of a target at set times of
+// the week, e.g. to raise the minimum ahead of a nightly batch import.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Window is a weekly time range during which the replica limits are
+// overridden. A limit left at -1 keeps the value of the base config.
+type Window struct {
+	// Spec is the window as written, to name it in logs and events
+	Spec string
+	// Days are the weekdays the window starts on
+	Days [7]bool
+	// Start and End are offsets from midnight. A window with End not after
+	// Start runs past midnight into the next day.
+	Start time.Duration
+	End   time.Duration
+	Min   int
+	Max   int
+	// Prescale is the replicas to scale up to, if fewer, as the window starts
+	Prescale int
+}
+
+// Schedule is a list of windows in the time zone Location. Where windows
+// overlap the first one listed applies.
+type Schedule struct {
+	Windows  []Window
+	Location *time.Location
+}
+
+var days = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parse reads a schedule of windows separated by semicolons, each given as
+// days, a time range and the limits to set, e.g.
+// "Mon-Fri 08:00-18:00 min=3 max=20; * 01:45-04:00 min=10 prescale=15".
+// Days are "*" for every day, or a comma separated list of days and ranges of
+// days such as "Mon-Fri,Sun". timezone is an IANA time zone name, UTC if empty.
+func Parse(spec string, timezone string) (Schedule, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return Schedule{}, errors.Wrapf(err, "Invalid schedule-timezone %q", timezone)
+	}
+
+	s := Schedule{Location: location}
+	for _, windowSpec := range strings.Split(spec, ";") {
+		if windowSpec = strings.TrimSpace(windowSpec); windowSpec == "" {
+			continue
+		}
+		window, err := parseWindow(windowSpec)
+		if err != nil {
+			return Schedule{}, errors.Wrapf(err, "Invalid schedule window %q", windowSpec)
+		}
+		s.Windows = append(s.Windows, window)
+	}
+	return s, nil
+}
+
+func parseWindow(spec string) (Window, error) {
+	w := Window{Spec: spec, Min: -1, Max: -1, Prescale: -1}
+	fields := strings.Fields(spec)
+	if len(fields) < 3 {
+		return w, errors.New("want days, a time range and at least one of min, max or prescale")
+	}
+
+	if err := w.parseDays(fields[0]); err != nil {
+		return w, err
+	}
+	times := strings.Split(fields[1], "-")
+	if len(times) != 2 {
+		return w, errors.Errorf("time range %q is not start-end", fields[1])
+	}
+	var err error
+	if w.Start, err = parseClock(times[0]); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(times[1]); err != nil {
+		return w, err
+	}
+
+	for _, setting := range fields[2:] {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return w, errors.Errorf("%q is not a setting=value pair", setting)
+		}
+		value, err := strconv.Atoi(kv[1])
+		if err != nil || value < 0 {
+			return w, errors.Errorf("%v %q is not a number of at least 0", kv[0], kv[1])
+		}
+		switch kv[0] {
+		case "min":
+			w.Min = value
+		case "max":
+			w.Max = value
+		case "prescale":
+			w.Prescale = value
+		default:
+			return w, errors.Errorf("unknown setting %q, want min, max or prescale", kv[0])
+		}
+	}
+	if w.Min >= 0 && w.Max >= 0 && w.Min > w.Max {
+		return w, errors.Errorf("min %v is above max %v", w.Min, w.Max)
+	}
+	return w, nil
+}
+
+func (w *Window) parseDays(spec string) error {
+	if spec == "*" {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+		return nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return errors.Errorf("day range %q is not first-last", part)
+		}
+		first, ok := days[strings.ToLower(bounds[0])]
+		if !ok {
+			return errors.Errorf("unknown day %q", bounds[0])
+		}
+		last, ok := days[strings.ToLower(bounds[len(bounds)-1])]
+		if !ok {
+			return errors.Errorf("unknown day %q", bounds[len(bounds)-1])
+		}
+		// ranges can wrap round the end of the week, e.g. Fri-Mon
+		for day := first; ; day = (day + 1) % 7 {
+			w.Days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock reads a time of day as HH:MM, allowing 24:00 for midnight at the
+// end of a range.
+func parseClock(clock string) (time.Duration, error) {
+	var hours, minutes int
+	if _, err := fmt.Sscanf(clock, "%d:%d", &hours, &minutes); err != nil || hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, errors.Errorf("time %q is not HH:MM", clock)
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Active returns the window that applies at t, or nil if none does.
+func (s Schedule) Active(t time.Time) *Window {
+	t = t.In(s.Location)
+	// the wall clock time, so windows keep their hours across daylight saving
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	yesterday := (t.Weekday() + 6) % 7
+
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if w.End > w.Start {
+			if w.Days[t.Weekday()] && sinceMidnight >= w.Start && sinceMidnight < w.End {
+				return w
+			}
+			continue
+		}
+		if (w.Days[t.Weekday()] && sinceMidnight >= w.Start) || (w.Days[yesterday] && sinceMidnight < w.End) {
+			return w
+		}
+	}
+	return nil
+}
+
+// Limits returns the min and max replicas in the window, taking any it does
+// not set from the base values given.
+func (w *Window) Limits(min int, max int) (int, int) {
+	if w.Min >= 0 {
+		min = w.Min
+	}
+	if w.Max >= 0 {
+		max = w.Max
+	}
+	return min, max
+}
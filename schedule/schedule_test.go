@@ -0,0 +1,61 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActive(t *testing.T) {
+	s, err := Parse("Mon-Fri 08:00-18:00 min=3 max=20; Sat,Sun 22:00-02:00 max=2; * 01:45-04:00 min=10 prescale=15", "Europe/London")
+	assert.Nil(t, err)
+	assert.Len(t, s.Windows, 3)
+
+	london, _ := time.LoadLocation("Europe/London")
+	at := func(day int, hour int, minute int) string {
+		// 2024-07-01 is a Monday
+		w := s.Active(time.Date(2024, time.July, day, hour, minute, 0, 0, london))
+		if w == nil {
+			return ""
+		}
+		return w.Spec
+	}
+	assert.Equal(t, "Mon-Fri 08:00-18:00 min=3 max=20", at(1, 8, 0))
+	assert.Equal(t, "", at(1, 18, 0), "The end of a window should be outside it")
+	assert.Equal(t, "", at(6, 12, 0))
+	assert.Equal(t, "Sat,Sun 22:00-02:00 max=2", at(7, 23, 0))
+	assert.Equal(t, "Sat,Sun 22:00-02:00 max=2", at(8, 1, 0), "Windows should run past midnight into the next day")
+	assert.Equal(t, "Sat,Sun 22:00-02:00 max=2", at(8, 1, 50), "The first of overlapping windows should apply")
+	assert.Equal(t, "* 01:45-04:00 min=10 prescale=15", at(9, 1, 50))
+	assert.Equal(t, "", at(6, 1, 0), "Windows past midnight should only run on from the days they start on")
+
+	w := s.Active(time.Date(2024, time.July, 1, 7, 30, 0, 0, time.UTC))
+	assert.NotNil(t, w, "Times should be compared in the schedule time zone")
+	min, max := w.Limits(1, 5)
+	assert.Equal(t, []int{3, 20}, []int{min, max})
+	min, max = s.Windows[1].Limits(1, 5)
+	assert.Equal(t, []int{1, 2}, []int{min, max}, "Limits not set by the window should be kept")
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"Mon-Fri 08:00-18:00",
+		"Mon-Fry 08:00-18:00 min=1",
+		"Mon 08:00 min=1",
+		"Mon 08:00-25:00 min=1",
+		"Mon 08:00-18:00 min=-1",
+		"Mon 08:00-18:00 floor=1",
+		"Mon 08:00-18:00 min=5 max=2",
+	} {
+		_, err := Parse(spec, "")
+		assert.NotNil(t, err, spec)
+	}
+
+	_, err := Parse("Mon 08:00-18:00 min=1", "Mars/Olympus_Mons")
+	assert.NotNil(t, err)
+
+	s, err := Parse("", "")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Active(time.Now()))
+}
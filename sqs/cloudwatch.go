@@ -0,0 +1,115 @@
+package sqs
+
+import (
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	"github.com/pkg/errors"
+	"github.com/uswitch/kube-sqs-autoscaler/monitor"
+)
+
+// CloudWatch is the part of the CloudWatch API used to read the metrics SQS
+// publishes for a queue.
+type CloudWatch interface {
+	GetMetricStatistics(*cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error)
+}
+
+// CloudWatchClient reads the SQS metrics of one queue from CloudWatch. SQS
+// publishes them once a minute, so they lag behind the queue attributes.
+type CloudWatchClient struct {
+	Client    CloudWatch
+	QueueName string
+	// MaxAge, if set, is how old the latest datapoint can be before it is
+	// taken as out of date and ignored
+	MaxAge time.Duration
+}
+
+func NewCloudWatchClient(queueUrl string, region string) *CloudWatchClient {
+	svc := cloudwatch.New(session.New(), &aws.Config{Region: aws.String(region)})
+	return &CloudWatchClient{
+		Client:    svc,
+		QueueName: QueueName(queueUrl),
+	}
+}
+
+// QueueName returns the name of the queue with the given url, which is the
+// dimension its CloudWatch metrics are published under.
+func QueueName(queueUrl string) string {
+	return path.Base(queueUrl)
+}
+
+// latest returns the most recent value of statistic for the queue's metric
+// over the last few minutes. If no datapoints were published, or the latest is
+// older than MaxAge, it returns 0.
+func (c *CloudWatchClient) latest(metricName string, statistic string) (float64, error) {
+	now := time.Now()
+	params := &cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/SQS"),
+		MetricName: aws.String(metricName),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("QueueName"), Value: aws.String(c.QueueName)},
+		},
+		StartTime:  aws.Time(now.Add(-10 * time.Minute)),
+		EndTime:    aws.Time(now),
+		Period:     aws.Int64(60),
+		Statistics: []*string{aws.String(statistic)},
+	}
+
+	start := time.Now()
+	out, err := c.Client.GetMetricStatistics(params)
+	monitor.ObserveRequest("cloudwatch", "get_metric_statistics", start, err)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to get %v from CloudWatch", metricName)
+	}
+
+	var latest *cloudwatch.Datapoint
+	for _, datapoint := range out.Datapoints {
+		if datapoint.Timestamp == nil {
+			continue
+		}
+		if latest == nil || datapoint.Timestamp.After(*latest.Timestamp) {
+			latest = datapoint
+		}
+	}
+	if latest == nil || (c.MaxAge > 0 && now.Sub(*latest.Timestamp) > c.MaxAge) {
+		return 0, nil
+	}
+
+	var value *float64
+	switch statistic {
+	case cloudwatch.StatisticMaximum:
+		value = latest.Maximum
+	case cloudwatch.StatisticSum:
+		value = latest.Sum
+	case cloudwatch.StatisticAverage:
+		value = latest.Average
+	}
+	if value == nil {
+		return 0, errors.Errorf("CloudWatch datapoint for %v has no %v", metricName, statistic)
+	}
+	return *value, nil
+}
+
+// AgeOfOldestMessage returns the age of the oldest message in the queue, from
+// the ApproximateAgeOfOldestMessage metric.
+func (c *CloudWatchClient) AgeOfOldestMessage() (time.Duration, error) {
+	seconds, err := c.latest("ApproximateAgeOfOldestMessage", cloudwatch.StatisticMaximum)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// DeletedRate returns the messages deleted from the queue per second over the
+// last minute published, from the NumberOfMessagesDeleted metric.
+func (c *CloudWatchClient) DeletedRate() (float64, error) {
+	deleted, err := c.latest("NumberOfMessagesDeleted", cloudwatch.StatisticSum)
+	if err != nil {
+		return 0, err
+	}
+	return deleted / 60, nil
+}
@@ -0,0 +1,102 @@
+package sqs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgeOfOldestMessage(t *testing.T) {
+	now := time.Now()
+	c := &CloudWatchClient{
+		Client: &MockCloudWatch{
+			Datapoints: []*cloudwatch.Datapoint{
+				{Timestamp: aws.Time(now.Add(-2 * time.Minute)), Maximum: aws.Float64(30)},
+				{Timestamp: aws.Time(now.Add(-1 * time.Minute)), Maximum: aws.Float64(90)},
+				{Timestamp: aws.Time(now.Add(-3 * time.Minute)), Maximum: aws.Float64(10)},
+			},
+		},
+		QueueName: "example",
+	}
+
+	age, err := c.AgeOfOldestMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, 90*time.Second, age, "The most recent datapoint should be used")
+
+	c.MaxAge = 30 * time.Second
+	age, err = c.AgeOfOldestMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), age, "A datapoint older than MaxAge should be ignored")
+
+	c.Client = &MockCloudWatch{}
+	age, err = c.AgeOfOldestMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), age)
+}
+
+func TestMessagesWithCloudWatch(t *testing.T) {
+	s := NewMockSqsClient()
+	s.CloudWatch = &CloudWatchClient{
+		Client: &MockCloudWatch{
+			Datapoints: []*cloudwatch.Datapoint{
+				{Timestamp: aws.Time(time.Now()), Maximum: aws.Float64(600)},
+			},
+		},
+		QueueName: "example",
+	}
+
+	messages, err := s.Messages()
+	assert.Nil(t, err)
+	assert.Equal(t, 50, messages.Visible)
+	assert.Equal(t, 10*time.Minute, messages.OldestAge)
+
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{Attributes: map[string]*string{}})
+	messages, err = s.Messages()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), messages.OldestAge, "The age should be ignored once the queue is empty")
+}
+
+func TestMessagesWithCloudWatchError(t *testing.T) {
+	s := NewMockSqsClient()
+	s.CloudWatch = &CloudWatchClient{
+		Client:    &MockCloudWatch{Err: errors.New("throttled")},
+		QueueName: "example",
+	}
+	s.ReadDeletedRate = true
+
+	backlog, err := s.Backlog()
+	assert.Nil(t, err, "A CloudWatch failure should not fail the backlog")
+	assert.Equal(t, 50, backlog.Messages)
+	assert.Equal(t, time.Duration(0), backlog.OldestAge)
+	assert.Equal(t, 0.0, backlog.ProcessedRate)
+}
+
+func TestDeletedRate(t *testing.T) {
+	s := NewMockSqsClient()
+	s.CloudWatch = &CloudWatchClient{
+		Client: &MockCloudWatch{
+			Datapoints: []*cloudwatch.Datapoint{
+				{Timestamp: aws.Time(time.Now()), Maximum: aws.Float64(600), Sum: aws.Float64(1200)},
+			},
+		},
+		QueueName: "example",
+	}
+
+	backlog, err := s.Backlog()
+	assert.Nil(t, err)
+	assert.Equal(t, 0.0, backlog.ProcessedRate, "The deleted rate should only be read when asked for")
+
+	s.ReadDeletedRate = true
+	backlog, err = s.Backlog()
+	assert.Nil(t, err)
+	assert.Equal(t, 20.0, backlog.ProcessedRate)
+}
+
+func TestQueueName(t *testing.T) {
+	assert.Equal(t, "crm-firehose-production", QueueName("https://sqs.eu-west-1.amazonaws.com/136393635417/crm-firehose-production"))
+}
@@ -0,0 +1,96 @@
+package sqs
+
+import (
+	"github.com/pkg/errors"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
+)
+
+// QueueSet combines the backlogs of several queues, e.g. a main queue and its
+// retry queue, into the one backlog a deployment is scaled on.
+type QueueSet struct {
+	Queues []*SqsClient
+	// Weights multiplies the backlog of the queue at the same index
+	Weights []float64
+	// Aggregation is conf.SumQueues or conf.MaxQueues
+	Aggregation string
+	region      string
+}
+
+func NewQueueSet(myConf conf.MyConfType) *QueueSet {
+	q := &QueueSet{}
+	q.Configure(myConf)
+	return q
+}
+
+// Configure applies the queue settings from myConf, e.g. after the config has
+// been reloaded. Clients are kept for queues that are still listed, and
+// created for new ones.
+func (q *QueueSet) Configure(myConf conf.MyConfType) {
+	existing := map[string]*SqsClient{}
+	if q.region == myConf.AwsRegion {
+		for _, queue := range q.Queues {
+			existing[queue.QueueUrl] = queue
+		}
+	}
+
+	q.Queues = nil
+	for _, url := range myConf.QueueUrls() {
+		queue, ok := existing[url]
+		if !ok {
+			queue = NewSqsClient(url, myConf.AwsRegion)
+		}
+		queue.Configure(myConf)
+		q.Queues = append(q.Queues, queue)
+	}
+
+	// the config has been validated, so the weights parse
+	q.Weights, _ = myConf.QueueWeights()
+	q.Aggregation = myConf.SqsQueueAggregation
+	q.region = myConf.AwsRegion
+}
+
+// Backlog returns the weighted sum or the largest weighted backlog of the
+// queues, with the backlog of each queue in the details so it can be seen
+// which one drove a scaling decision.
+func (q *QueueSet) Backlog() (metric.Backlog, error) {
+	if len(q.Queues) == 1 && q.Weights[0] == 1 {
+		return q.Queues[0].Backlog()
+	}
+
+	var total float64
+	backlog := metric.Backlog{
+		Empty:   true,
+		Details: map[string]interface{}{"aggregation": q.Aggregation},
+	}
+
+	for i, queue := range q.Queues {
+		b, err := queue.Backlog()
+		if err != nil {
+			return metric.Backlog{}, errors.Wrapf(err, "queue %v", queue.QueueUrl)
+		}
+
+		weighted := float64(b.Messages) * q.Weights[i]
+		backlog.Details[QueueName(queue.QueueUrl)] = weighted
+
+		// the processed rate is weighted like the backlog, so they can be
+		// compared
+		if q.Aggregation == conf.MaxQueues {
+			if i == 0 || weighted > total {
+				total = weighted
+				backlog.ProcessedRate = b.ProcessedRate * q.Weights[i]
+				backlog.Details["drivingQueue"] = QueueName(queue.QueueUrl)
+			}
+		} else {
+			total += weighted
+			backlog.ProcessedRate += b.ProcessedRate * q.Weights[i]
+		}
+		backlog.Empty = backlog.Empty && b.Empty
+		if b.OldestAge > backlog.OldestAge {
+			backlog.OldestAge = b.OldestAge
+		}
+	}
+
+	backlog.Messages = int(total)
+	return backlog, nil
+}
@@ -0,0 +1,64 @@
+package sqs
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+)
+
+func newMockQueue(url string, messages string) *SqsClient {
+	s := NewMockSqsClient()
+	s.QueueUrl = url
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{"ApproximateNumberOfMessages": aws.String(messages)},
+	})
+	return s
+}
+
+func TestQueueSetBacklog(t *testing.T) {
+	q := &QueueSet{
+		Queues: []*SqsClient{
+			newMockQueue("https://example.com/main", "100"),
+			newMockQueue("https://example.com/retry", "300"),
+		},
+		Weights:     []float64{1, 0.5},
+		Aggregation: conf.SumQueues,
+	}
+
+	backlog, err := q.Backlog()
+	assert.Nil(t, err)
+	assert.Equal(t, 250, backlog.Messages)
+	assert.Equal(t, 150.0, backlog.Details["retry"])
+
+	q.Aggregation = conf.MaxQueues
+	backlog, err = q.Backlog()
+	assert.Nil(t, err)
+	assert.Equal(t, 150, backlog.Messages)
+	assert.Equal(t, "retry", backlog.Details["drivingQueue"])
+	assert.False(t, backlog.Empty)
+
+	q.Queues[0] = newMockQueue("https://example.com/main", "0")
+	q.Queues[1] = newMockQueue("https://example.com/retry", "0")
+	backlog, err = q.Backlog()
+	assert.Nil(t, err)
+	assert.True(t, backlog.Empty, "The queues together should be empty only if each is")
+}
+
+func TestQueueSetConfigure(t *testing.T) {
+	myConf := conf.Defaults()
+	myConf.SqsQueueUrl = "https://example.com/main"
+	q := NewQueueSet(myConf)
+	assert.Equal(t, 1, len(q.Queues))
+	main := q.Queues[0]
+
+	myConf.SqsQueueUrl = "https://example.com/main https://example.com/retry"
+	myConf.SqsQueueWeights = "2 1"
+	q.Configure(myConf)
+	assert.Equal(t, 2, len(q.Queues))
+	assert.True(t, main == q.Queues[0], "The client of a queue still listed should be kept")
+	assert.Equal(t, "https://example.com/retry", q.Queues[1].QueueUrl)
+	assert.Equal(t, []float64{2, 1}, q.Weights)
+}
@@ -2,48 +2,204 @@ package sqs
 
 import (
 	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
+	"github.com/uswitch/kube-sqs-autoscaler/monitor"
 )
 
+func init() {
+	metric.Register("sqs", func(myConf conf.MyConfType) (metric.Source, error) {
+		return NewQueueSet(myConf), nil
+	})
+}
+
 type SQS interface {
 	GetQueueAttributes(*sqs.GetQueueAttributesInput) (*sqs.GetQueueAttributesOutput, error)
 	// only implemented on unit tests
 	SetQueueAttributes(*sqs.SetQueueAttributesInput) (*sqs.SetQueueAttributesOutput, error)
 }
 
+// Messages is the breakdown of the messages in a queue.
+type Messages struct {
+	// Visible messages are waiting to be received (ApproximateNumberOfMessages)
+	Visible int
+	// InFlight messages have been received but not yet deleted
+	// (ApproximateNumberOfMessagesNotVisible)
+	InFlight int
+	// Delayed messages are not yet available to be received
+	// (ApproximateNumberOfMessagesDelayed)
+	Delayed int
+	// OldestAge is the age of the oldest message in the queue, only set when
+	// the client reads it from CloudWatch
+	OldestAge time.Duration
+	// DeletedRate is the messages deleted per second, only set when the client
+	// reads it from CloudWatch
+	DeletedRate float64
+}
+
+// Weights says how much each kind of message counts towards the backlog used
+// for scaling.
+type Weights struct {
+	Visible  float64
+	InFlight float64
+	Delayed  float64
+}
+
+// Backlog returns the weighted sum of the messages.
+func (m Messages) Backlog(w Weights) int {
+	return int(float64(m.Visible)*w.Visible + float64(m.InFlight)*w.InFlight + float64(m.Delayed)*w.Delayed)
+}
+
+// cloudWatchDelay is how long SQS can take to publish a datapoint of its
+// once a minute metrics to CloudWatch.
+const cloudWatchDelay = 3 * time.Minute
+
 type SqsClient struct {
 	Client   SQS
 	QueueUrl string
+	Weights  Weights
+	// CloudWatch, if set, is used to read the age of the oldest message
+	CloudWatch *CloudWatchClient
+	// ReadDeletedRate reads the rate messages are deleted from CloudWatch too
+	ReadDeletedRate bool
 }
 
 func NewSqsClient(queue string, region string) *SqsClient {
 	svc := sqs.New(session.New(), &aws.Config{Region: aws.String(region)})
 	return &SqsClient{
-		svc,
-		queue,
+		Client:   svc,
+		QueueUrl: queue,
+		Weights:  Weights{Visible: 1},
 	}
 }
 
-func (s *SqsClient) NumMessages() (int, error) {
+// Configure applies the message weights and age settings from myConf, e.g.
+// after the config has been reloaded. The queue url is left as it is, as the
+// config can list several queues. A change of region needs a new client.
+func (s *SqsClient) Configure(myConf conf.MyConfType) {
+	s.Weights = Weights{
+		Visible:  myConf.VisibleMessagesWeight,
+		InFlight: myConf.InFlightMessagesWeight,
+		Delayed:  myConf.DelayedMessagesWeight,
+	}
+
+	s.ReadDeletedRate = myConf.ScalingMode == conf.Throughput && myConf.PodThroughput == 0 && myConf.ThroughputSource == conf.CloudWatchThroughput
+
+	if myConf.ScaleUpAge == 0 && !s.ReadDeletedRate {
+		s.CloudWatch = nil
+		return
+	}
+	if s.CloudWatch == nil {
+		s.CloudWatch = NewCloudWatchClient(s.QueueUrl, myConf.AwsRegion)
+	} else {
+		s.CloudWatch.QueueName = QueueName(s.QueueUrl)
+	}
+	s.CloudWatch.MaxAge = cloudWatchMaxAge(myConf.PollInterval)
+}
+
+// cloudWatchMaxAge returns how old a CloudWatch datapoint can be and still be
+// used: two polls, but no less than the few minutes SQS takes to publish.
+func cloudWatchMaxAge(pollInterval time.Duration) time.Duration {
+	if maxAge := 2 * pollInterval; maxAge > cloudWatchDelay {
+		return maxAge
+	}
+	return cloudWatchDelay
+}
+
+// Messages returns the number of visible, in flight and delayed messages in
+// the queue, and the age of the oldest message if CloudWatch is set and the
+// queue is not empty. A failure to read CloudWatch is logged and leaves the
+// age and deleted rate at 0, so scaling carries on from the messages alone.
+func (s *SqsClient) Messages() (Messages, error) {
 	params := &sqs.GetQueueAttributesInput{
-		AttributeNames: []*string{aws.String("ApproximateNumberOfMessages")},
-		QueueUrl:       aws.String(s.QueueUrl),
+		AttributeNames: []*string{
+			aws.String("ApproximateNumberOfMessages"),
+			aws.String("ApproximateNumberOfMessagesNotVisible"),
+			aws.String("ApproximateNumberOfMessagesDelayed"),
+		},
+		QueueUrl: aws.String(s.QueueUrl),
 	}
 
+	start := time.Now()
 	out, err := s.Client.GetQueueAttributes(params)
+	monitor.ObserveRequest("sqs", "get_queue_attributes", start, err)
 	if err != nil {
-		return 0, errors.Wrap(err, "Failed to get messages in SQS")
+		return Messages{}, errors.Wrap(err, "Failed to get messages in SQS")
 	}
 
-	messages, err := strconv.Atoi(*out.Attributes["ApproximateNumberOfMessages"])
-	if err != nil {
-		return 0, errors.Wrap(err, "Failed to get number of messages in queue")
+	var messages Messages
+	for name, count := range map[string]*int{
+		"ApproximateNumberOfMessages":           &messages.Visible,
+		"ApproximateNumberOfMessagesNotVisible": &messages.InFlight,
+		"ApproximateNumberOfMessagesDelayed":    &messages.Delayed,
+	} {
+		value, ok := out.Attributes[name]
+		if !ok || value == nil {
+			continue
+		}
+		if *count, err = strconv.Atoi(*value); err != nil {
+			return Messages{}, errors.Wrapf(err, "Failed to get %v in queue", name)
+		}
+	}
+
+	queue := QueueName(s.QueueUrl)
+	monitor.QueueMessages.WithLabelValues(queue, "visible").Set(float64(messages.Visible))
+	monitor.QueueMessages.WithLabelValues(queue, "in_flight").Set(float64(messages.InFlight))
+	monitor.QueueMessages.WithLabelValues(queue, "delayed").Set(float64(messages.Delayed))
+
+	if s.CloudWatch != nil {
+		empty := messages.Visible == 0 && messages.InFlight == 0 && messages.Delayed == 0
+		if !empty {
+			if messages.OldestAge, err = s.CloudWatch.AgeOfOldestMessage(); err != nil {
+				log.WithFields(log.Fields{"sqs-queue": s.QueueUrl, "error": err}).Warn("Ignoring the age of the oldest message")
+			}
+		}
+		if s.ReadDeletedRate {
+			if messages.DeletedRate, err = s.CloudWatch.DeletedRate(); err != nil {
+				log.WithFields(log.Fields{"sqs-queue": s.QueueUrl, "error": err}).Warn("Ignoring the rate messages are deleted")
+			}
+		}
 	}
 
 	return messages, nil
 }
+
+// NumMessages returns the backlog of the queue, weighting each kind of message
+// by Weights.
+func (s *SqsClient) NumMessages() (int, error) {
+	messages, err := s.Messages()
+	if err != nil {
+		return 0, err
+	}
+	return messages.Backlog(s.Weights), nil
+}
+
+// Backlog returns the weighted backlog of the queue, broken down into its
+// visible, in flight and delayed messages.
+func (s *SqsClient) Backlog() (metric.Backlog, error) {
+	messages, err := s.Messages()
+	if err != nil {
+		return metric.Backlog{}, err
+	}
+
+	return metric.Backlog{
+		Messages:      messages.Backlog(s.Weights),
+		OldestAge:     messages.OldestAge,
+		ProcessedRate: messages.DeletedRate,
+		Empty:         messages.Visible == 0 && messages.InFlight == 0 && messages.Delayed == 0,
+		Details: map[string]interface{}{
+			"sqs-queue":        s.QueueUrl,
+			"visibleMessages":  messages.Visible,
+			"inFlightMessages": messages.InFlight,
+			"delayedMessages":  messages.Delayed,
+		},
+	}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +17,55 @@ func TestNumMessages(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestMessages(t *testing.T) {
+	s := NewMockSqsClient()
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{
+			"ApproximateNumberOfMessages":           aws.String("50"),
+			"ApproximateNumberOfMessagesNotVisible": aws.String("1000"),
+			"ApproximateNumberOfMessagesDelayed":    aws.String("10"),
+		},
+	})
+
+	messages, err := s.Messages()
+	assert.Nil(t, err)
+	assert.Equal(t, Messages{Visible: 50, InFlight: 1000, Delayed: 10}, messages)
+
+	num, err := s.NumMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 50, num, "Only visible messages should count by default")
+
+	s.Weights = Weights{Visible: 1, InFlight: 0.5, Delayed: 1}
+	num, err = s.NumMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, 560, num)
+
+	backlog, err := s.Backlog()
+	assert.Nil(t, err)
+	assert.Equal(t, 560, backlog.Messages)
+	assert.Equal(t, 1000, backlog.Details["inFlightMessages"])
+	assert.False(t, backlog.Empty)
+
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{"ApproximateNumberOfMessagesNotVisible": aws.String("3")},
+	})
+	s.Weights = Weights{Visible: 1}
+	backlog, err = s.Backlog()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, backlog.Messages)
+	assert.False(t, backlog.Empty, "A queue with messages in flight should not be empty, whatever their weight")
+}
+
+func TestMessagesInvalidAttribute(t *testing.T) {
+	s := NewMockSqsClient()
+	s.Client.SetQueueAttributes(&sqs.SetQueueAttributesInput{
+		Attributes: map[string]*string{"ApproximateNumberOfMessagesNotVisible": aws.String("lots")},
+	})
+
+	_, err := s.Messages()
+	assert.NotNil(t, err)
+}
+
 type MockSQS struct {
 	QueueAttributes *sqs.GetQueueAttributesOutput
 }
@@ -43,5 +93,18 @@ func NewMockSqsClient() *SqsClient {
 			},
 		},
 		QueueUrl: "example.com",
+		Weights:  Weights{Visible: 1},
+	}
+}
+
+type MockCloudWatch struct {
+	Datapoints []*cloudwatch.Datapoint
+	Err        error
+}
+
+func (m *MockCloudWatch) GetMetricStatistics(*cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	if m.Err != nil {
+		return nil, m.Err
 	}
+	return &cloudwatch.GetMetricStatisticsOutput{Datapoints: m.Datapoints}, nil
 }
@@ -0,0 +1,121 @@
+// Package state saves what a polling loop needs to carry on where it left
+// off, e.g. after a restart or a change of leader.
+package state
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// saveAttempts is how many times a save is tried when other targets keep
+// changing the same ConfigMap.
+const saveAttempts = 5
+
+// State is the cool off state of a target and its last scaling decision.
+type State struct {
+	LastScaleUpTime   time.Time `json:"lastScaleUpTime"`
+	LastScaleDownTime time.Time `json:"lastScaleDownTime"`
+	DesiredReplicas   int       `json:"desiredReplicas"`
+	LastDecision      string    `json:"lastDecision"`
+}
+
+// Store loads and saves the State of one target.
+type Store interface {
+	// Load returns the saved state, and false if there is none
+	Load() (State, bool, error)
+	Save(state State) error
+}
+
+// MemoryStore keeps the state in memory, so it only lasts as long as the
+// process, e.g. to carry it over when the polling loop of a target is
+// restarted to apply a new config.
+type MemoryStore struct {
+	mu    sync.Mutex
+	state State
+	saved bool
+}
+
+func (m *MemoryStore) Load() (State, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, m.saved, nil
+}
+
+func (m *MemoryStore) Save(state State) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state, m.saved = state, true
+	return nil
+}
+
+// ConfigMapClient is the part of the kubernetes client used to store state.
+type ConfigMapClient interface {
+	ConfigMaps(namespace string) kclient.ConfigMapsInterface
+}
+
+// ConfigMapStore keeps the state as JSON under Key in the ConfigMap
+// Namespace/Name, which is created if missing. Targets in the same namespace
+// can share the ConfigMap with different keys.
+type ConfigMapStore struct {
+	Client    ConfigMapClient
+	Namespace string
+	Name      string
+	Key       string
+}
+
+func (c *ConfigMapStore) Load() (State, bool, error) {
+	configMap, err := c.Client.ConfigMaps(c.Namespace).Get(c.Name)
+	if apierrors.IsNotFound(err) {
+		return State{}, false, nil
+	}
+	if err != nil {
+		return State{}, false, errors.Wrapf(err, "Failed to get state from ConfigMap %v/%v", c.Namespace, c.Name)
+	}
+
+	value, ok := configMap.Data[c.Key]
+	if !ok {
+		return State{}, false, nil
+	}
+	var state State
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return State{}, false, errors.Wrapf(err, "Failed to decode state %v in ConfigMap %v/%v", c.Key, c.Namespace, c.Name)
+	}
+	return state, true, nil
+}
+
+// Save writes state under Key, retrying with a fresh read if the ConfigMap
+// was changed, e.g. by another target, since it was read.
+func (c *ConfigMapStore) Save(state State) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode state")
+	}
+
+	configMaps := c.Client.ConfigMaps(c.Namespace)
+	for attempt := 1; ; attempt++ {
+		configMap, err := configMaps.Get(c.Name)
+		if apierrors.IsNotFound(err) {
+			configMap = &api.ConfigMap{ObjectMeta: api.ObjectMeta{Name: c.Name, Namespace: c.Namespace}, Data: map[string]string{c.Key: string(value)}}
+			_, err = configMaps.Create(configMap)
+		} else if err == nil {
+			if configMap.Data == nil {
+				configMap.Data = map[string]string{}
+			}
+			configMap.Data[c.Key] = string(value)
+			_, err = configMaps.Update(configMap)
+		}
+
+		if err == nil {
+			return nil
+		}
+		if !(apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)) || attempt >= saveAttempts {
+			return errors.Wrapf(err, "Failed to save state to ConfigMap %v/%v", c.Namespace, c.Name)
+		}
+	}
+}
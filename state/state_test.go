@@ -0,0 +1,135 @@
+package state
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/kubernetes/pkg/api"
+	apierrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+func TestConfigMapStore(t *testing.T) {
+	client := &MockConfigMapClient{}
+	worker := &ConfigMapStore{Client: client, Namespace: "test", Name: "state", Key: "worker"}
+	mailer := &ConfigMapStore{Client: client, Namespace: "test", Name: "state", Key: "mailer"}
+
+	_, ok, err := worker.Load()
+	assert.Nil(t, err)
+	assert.False(t, ok, "There should be no state before the first save")
+
+	saved := State{
+		LastScaleUpTime:   time.Date(2018, 8, 1, 12, 0, 0, 0, time.UTC),
+		LastScaleDownTime: time.Date(2018, 8, 1, 11, 0, 0, 0, time.UTC),
+		DesiredReplicas:   4,
+		LastDecision:      "scale up to 4 replicas: 1200 messages, at or above scale-up-messages 1000",
+	}
+	assert.Nil(t, worker.Save(saved))
+	_, ok, _ = mailer.Load()
+	assert.False(t, ok, "Targets sharing the ConfigMap should not see each other's state")
+
+	client.conflicts = 2
+	assert.Nil(t, mailer.Save(State{DesiredReplicas: 1}), "A save should be retried when the ConfigMap changed since it was read")
+
+	loaded, ok, err := worker.Load()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, saved, loaded)
+	loaded, _, _ = mailer.Load()
+	assert.Equal(t, 1, loaded.DesiredReplicas)
+
+	client.conflicts = saveAttempts
+	assert.NotNil(t, worker.Save(saved), "The number of attempts should be bounded")
+
+	client.configMap.Data["worker"] = "{"
+	_, _, err = worker.Load()
+	assert.NotNil(t, err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := &MemoryStore{}
+	_, ok, err := store.Load()
+	assert.Nil(t, err)
+	assert.False(t, ok, "There should be no state before the first save")
+
+	saved := State{LastScaleUpTime: time.Now(), DesiredReplicas: 4}
+	assert.Nil(t, store.Save(saved))
+	loaded, ok, err := store.Load()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, saved, loaded)
+}
+
+// MockConfigMapClient holds a single ConfigMap and checks resource versions
+// on update as the api server does.
+type MockConfigMapClient struct {
+	configMap *api.ConfigMap
+	version   int
+	// conflicts is the number of updates to reject as if the ConfigMap changed
+	conflicts int
+}
+
+type MockConfigMaps struct {
+	client *MockConfigMapClient
+}
+
+func (m *MockConfigMapClient) ConfigMaps(namespace string) kclient.ConfigMapsInterface {
+	return &MockConfigMaps{client: m}
+}
+
+func copyConfigMap(c *api.ConfigMap) *api.ConfigMap {
+	copied := *c
+	copied.Data = map[string]string{}
+	for k, v := range c.Data {
+		copied.Data[k] = v
+	}
+	return &copied
+}
+
+func (m *MockConfigMaps) Get(name string) (*api.ConfigMap, error) {
+	if m.client.configMap == nil {
+		return nil, apierrors.NewNotFound(api.Resource("configmaps"), name)
+	}
+	return copyConfigMap(m.client.configMap), nil
+}
+
+func (m *MockConfigMaps) Create(c *api.ConfigMap) (*api.ConfigMap, error) {
+	if m.client.configMap != nil {
+		return nil, apierrors.NewAlreadyExists(api.Resource("configmaps"), c.Name)
+	}
+	m.client.version++
+	m.client.configMap = copyConfigMap(c)
+	m.client.configMap.ResourceVersion = strconv.Itoa(m.client.version)
+	return copyConfigMap(m.client.configMap), nil
+}
+
+func (m *MockConfigMaps) Update(c *api.ConfigMap) (*api.ConfigMap, error) {
+	if m.client.conflicts > 0 {
+		m.client.conflicts--
+		m.client.version++
+		m.client.configMap.ResourceVersion = strconv.Itoa(m.client.version)
+	}
+	if c.ResourceVersion != m.client.configMap.ResourceVersion {
+		return nil, apierrors.NewConflict(api.Resource("configmaps"), c.Name, fmt.Errorf("the object has been modified"))
+	}
+	m.client.version++
+	m.client.configMap = copyConfigMap(c)
+	m.client.configMap.ResourceVersion = strconv.Itoa(m.client.version)
+	return copyConfigMap(m.client.configMap), nil
+}
+
+func (m *MockConfigMaps) List(opts api.ListOptions) (*api.ConfigMapList, error) {
+	return nil, nil
+}
+
+func (m *MockConfigMaps) Delete(name string) error {
+	return nil
+}
+
+func (m *MockConfigMaps) Watch(opts api.ListOptions) (watch.Interface, error) {
+	return nil, nil
+}
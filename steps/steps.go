@@ -0,0 +1,130 @@
+// Package steps reads step scaling tables, which pick how to change the
+// replicas of a target from the band of backlog sizes the queue is in, e.g.
+// adding one replica above 1000 messages but five above 10000.
+package steps
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Band is a range of backlog sizes and the change to the replicas within it.
+type Band struct {
+	// Spec is the band as written, to name it in logs and events
+	Spec string
+	// Lower is the smallest backlog in the band, and Upper the smallest above
+	// it, or -1 if the band has no upper bound
+	Lower int
+	Upper int
+	// Op is one of *, /, + or - to step the replicas by Amount, or = to set
+	// them to Amount, or to the limit named by Limit if set
+	Op     string
+	Amount float64
+	// Limit is max or min to set the replicas to max-pods or min-pods
+	Limit string
+}
+
+// Table is a list of bands in increasing order of backlog, with no gaps or
+// overlaps between them.
+type Table struct {
+	Bands []Band
+}
+
+// Parse reads a table of bands separated by semicolons, each given as a
+// backlog range and a change, e.g. "1000-10000 +1; 10000-50000 +5; 50000- =max".
+// A range includes its lower bound but not its upper bound, and only the last
+// may leave the upper bound out. A change is an operator and amount, one of
+// *, /, + or -, or = with a number of replicas, max or min.
+func Parse(spec string) (Table, error) {
+	var t Table
+	for _, bandSpec := range strings.Split(spec, ";") {
+		if bandSpec = strings.TrimSpace(bandSpec); bandSpec == "" {
+			continue
+		}
+		band, err := parseBand(bandSpec)
+		if err != nil {
+			return Table{}, errors.Wrapf(err, "Invalid step %q", bandSpec)
+		}
+		if n := len(t.Bands); n > 0 {
+			last := t.Bands[n-1]
+			switch {
+			case last.Upper < 0 || band.Lower < last.Upper:
+				return Table{}, errors.Errorf("Step %q overlaps step %q", bandSpec, last.Spec)
+			case band.Lower > last.Upper:
+				return Table{}, errors.Errorf("Gap from %v to %v between steps %q and %q", last.Upper, band.Lower, last.Spec, bandSpec)
+			}
+		}
+		t.Bands = append(t.Bands, band)
+	}
+	return t, nil
+}
+
+func parseBand(spec string) (Band, error) {
+	b := Band{Spec: spec, Upper: -1}
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return b, errors.New("want a backlog range and a change, e.g. 1000-10000 +1")
+	}
+
+	bounds := strings.Split(fields[0], "-")
+	if len(bounds) != 2 {
+		return b, errors.Errorf("range %q is not lower-upper", fields[0])
+	}
+	var err error
+	if b.Lower, err = strconv.Atoi(bounds[0]); err != nil || b.Lower < 0 {
+		return b, errors.Errorf("lower bound %q is not a number of at least 0", bounds[0])
+	}
+	if bounds[1] != "" {
+		if b.Upper, err = strconv.Atoi(bounds[1]); err != nil || b.Upper <= b.Lower {
+			return b, errors.Errorf("upper bound %q is not a number above the lower bound", bounds[1])
+		}
+	}
+
+	change := fields[1]
+	b.Op = change[:1]
+	value := change[1:]
+	switch b.Op {
+	case "=":
+		if value == "max" || value == "min" {
+			b.Limit = value
+			return b, nil
+		}
+		replicas, err := strconv.Atoi(value)
+		if err != nil || replicas < 0 {
+			return b, errors.Errorf("replicas %q is not a number of at least 0, max or min", value)
+		}
+		b.Amount = float64(replicas)
+	case "*", "/", "+", "-":
+		if b.Amount, err = strconv.ParseFloat(value, 64); err != nil || b.Amount < 0 || (b.Amount == 0 && (b.Op == "*" || b.Op == "/")) {
+			return b, errors.Errorf("amount %q is not a number above 0", value)
+		}
+	default:
+		return b, errors.Errorf("change %q is not one of *, /, +, - or = followed by an amount", change)
+	}
+	return b, nil
+}
+
+// Band returns the band messages is in, or nil if it is in none.
+func (t Table) Band(messages int) *Band {
+	for i := range t.Bands {
+		b := &t.Bands[i]
+		if messages >= b.Lower && (b.Upper < 0 || messages < b.Upper) {
+			return b
+		}
+	}
+	return nil
+}
+
+// Overlaps returns whether any band of t overlaps a band of other.
+func (t Table) Overlaps(other Table) bool {
+	for _, a := range t.Bands {
+		for _, b := range other.Bands {
+			if (b.Upper < 0 || a.Lower < b.Upper) && (a.Upper < 0 || b.Lower < a.Upper) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package steps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	table, err := Parse("1000-10000 +1; 10000-50000 +5; 50000- =max")
+	assert.Nil(t, err)
+	assert.Len(t, table.Bands, 3)
+	assert.Equal(t, Band{Spec: "10000-50000 +5", Lower: 10000, Upper: 50000, Op: "+", Amount: 5}, table.Bands[1])
+	assert.Equal(t, "max", table.Bands[2].Limit)
+
+	table, err = Parse("0-10 =1; 10-100 /2")
+	assert.Nil(t, err)
+	assert.Equal(t, Band{Spec: "0-10 =1", Lower: 0, Upper: 10, Op: "=", Amount: 1}, table.Bands[0])
+
+	empty, err := Parse("")
+	assert.Nil(t, err)
+	assert.Nil(t, empty.Band(0))
+
+	for _, spec := range []string{
+		"1000-10000 +1; 9000-50000 +5",
+		"1000- +1; 10000-50000 +5",
+		"1000-10000 +1; 20000-50000 +5",
+		"10000-50000 +5; 1000-10000 +1",
+		"1000-1000 +1",
+		"1000-10000",
+		"1000-10000 %2",
+		"1000-10000 *0",
+		"1000-10000 =all",
+		"-10 +1",
+	} {
+		_, err := Parse(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestBand(t *testing.T) {
+	table, _ := Parse("1000-10000 +1; 10000-50000 +5; 50000- =max")
+	assert.Nil(t, table.Band(999))
+	assert.Equal(t, "1000-10000 +1", table.Band(1000).Spec)
+	assert.Equal(t, "10000-50000 +5", table.Band(10000).Spec, "The upper bound of a band should be outside it")
+	assert.Equal(t, "50000- =max", table.Band(1000000).Spec)
+}
+
+func TestOverlaps(t *testing.T) {
+	up, _ := Parse("1000-10000 +1; 10000- =max")
+	down, _ := Parse("0-100 =min; 100-1000 -1")
+	assert.False(t, up.Overlaps(down))
+	assert.False(t, down.Overlaps(Table{}))
+
+	down, _ = Parse("0-100 =min; 100-1001 -1")
+	assert.True(t, up.Overlaps(down))
+	assert.True(t, down.Overlaps(up))
+	down, _ = Parse("20000- -1")
+	assert.True(t, up.Overlaps(down))
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/uswitch/kube-sqs-autoscaler/conf"
+	"github.com/uswitch/kube-sqs-autoscaler/metric"
+	"github.com/uswitch/kube-sqs-autoscaler/monitor"
+	"github.com/uswitch/kube-sqs-autoscaler/scale"
+	"github.com/uswitch/kube-sqs-autoscaler/sqs"
+	"github.com/uswitch/kube-sqs-autoscaler/state"
+)
+
+// targetFlags collects every -target flag given on the command line.
+type targetFlags []string
+
+func (t *targetFlags) String() string {
+	return strings.Join(*t, " ")
+}
+
+func (t *targetFlags) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+// flagOverrides returns the per-target flags explicitly set on the command
+// line, which take precedence over values from the config file. Flags of the
+// process as a whole, e.g. leader-elect, are left out.
+func flagOverrides() map[string]string {
+	targetFlags := flag.NewFlagSet("target", flag.ContinueOnError)
+	conf.RegisterFlags(targetFlags, &conf.MyConfType{})
+
+	overrides := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		if targetFlags.Lookup(f.Name) != nil {
+			overrides[f.Name] = f.Value.String()
+		}
+	})
+	return overrides
+}
+
+// loadTargets builds the list of targets to scale from the config file, the
+// command line flags and any -target flags, in increasing order of precedence.
+// Without a targets list in the file or -target flags, the top level settings
+// describe a single target; otherwise they are the defaults for each target.
+func loadTargets(myConf conf.MyConfType, targetSpecs []string) ([]conf.MyConfType, error) {
+	var targets []conf.MyConfType
+
+	if myConf.ConfigFile != "" {
+		base, fileTargets, err := conf.Load(myConf.ConfigFile, conf.Defaults())
+		if err != nil {
+			return nil, err
+		}
+		overrides := flagOverrides()
+		for name, value := range overrides {
+			if err := base.Set(name, value); err != nil {
+				return nil, err
+			}
+			for i := range fileTargets {
+				if err := fileTargets[i].Set(name, value); err != nil {
+					return nil, err
+				}
+			}
+		}
+		myConf, targets = base, fileTargets
+	}
+
+	for _, spec := range targetSpecs {
+		target, err := conf.ParseTarget(myConf, spec)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		targets = []conf.MyConfType{myConf}
+	}
+	return targets, nil
+}
+
+func targetKey(myConf conf.MyConfType) string {
+	return myConf.KubernetesNamespace + "/" + myConf.KubernetesDeploymentName
+}
+
+// activeTargets drops the targets with active=false and validates the rest,
+// so a config is either accepted as a whole or not at all.
+func activeTargets(targets []conf.MyConfType) ([]conf.MyConfType, error) {
+	var active []conf.MyConfType
+	seen := map[string]bool{}
+
+	for _, target := range targets {
+		if !target.Active {
+			log.Infof("active flag set to false for deployment %v, will not monitor queue", target.KubernetesDeploymentName)
+			continue
+		}
+		if err := target.Validate(); err != nil {
+			return nil, err
+		}
+		if _, err := scale.ParseKind(target.KubernetesKind); err != nil {
+			return nil, err
+		}
+		if _, err := scale.NewPolicy(target); err != nil {
+			return nil, err
+		}
+		if !metric.Registered(target.Source) {
+			return nil, errors.Errorf("source %v not in the registered set of %v", target.Source, metric.Names())
+		}
+		if seen[targetKey(target)] {
+			return nil, errors.Errorf("deployment %v is configured more than once", targetKey(target))
+		}
+		seen[targetKey(target)] = true
+		active = append(active, target)
+	}
+	return active, nil
+}
+
+// runningTarget is a target whose polling loop has been started. Closing
+// updates stops the loop, and done, if the loop was started, is closed once it
+// has returned. A target
+// that failed to start is kept, with failed set, so its health is reported
+// until it is started on the next reload.
+type runningTarget struct {
+	myConf  conf.MyConfType
+	updates chan conf.MyConfType
+	done    chan struct{}
+	failed  bool
+	// memory keeps the cool off state of a target without state-configmap,
+	// so it is carried over when the loop is restarted
+	memory *state.MemoryStore
+}
+
+// stop stops the polling loop and waits for it to return, so a poll in
+// progress cannot scale the target alongside a loop started after it.
+func (r *runningTarget) stop() {
+	close(r.updates)
+	if r.done != nil {
+		<-r.done
+	}
+}
+
+// supervisor starts, updates and stops the polling loop of each target as the
+// config changes. Targets are identified by namespace and deployment name.
+type supervisor struct {
+	running map[string]*runningTarget
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{running: map[string]*runningTarget{}}
+}
+
+// needsRestart reports whether a target has to be started again to apply
+// newConf, because it changes the clients built when the target starts rather
+// than settings the polling loop can pick up.
+func needsRestart(oldConf conf.MyConfType, newConf conf.MyConfType) bool {
+	return oldConf.KubernetesKind != newConf.KubernetesKind ||
+		oldConf.Kubeconfig != newConf.Kubeconfig ||
+		oldConf.KubernetesContext != newConf.KubernetesContext ||
+		oldConf.StateConfigMap != newConf.StateConfigMap ||
+		oldConf.Source != newConf.Source ||
+		oldConf.AwsRegion != newConf.AwsRegion
+}
+
+// apply makes the running loops match targets. Loops of unchanged targets are
+// left alone and changed ones are updated in place, keeping their cool off
+// state; changes that need new clients restart the loop.
+func (s *supervisor) apply(targets []conf.MyConfType) {
+	seen := map[string]bool{}
+
+	for _, target := range targets {
+		key := targetKey(target)
+		seen[key] = true
+
+		r, ok := s.running[key]
+		if ok && !r.failed && !needsRestart(r.myConf, target) {
+			if !reflect.DeepEqual(r.myConf, target) {
+				r.myConf = target
+				status.track(key, target.PollInterval)
+				// only the latest config matters, so replace any update
+				// the loop has not picked up yet rather than blocking on it
+				select {
+				case <-r.updates:
+				default:
+				}
+				r.updates <- target
+			}
+			continue
+		}
+		memory := &state.MemoryStore{}
+		if ok {
+			r.stop()
+			delete(s.running, key)
+			memory = r.memory
+		}
+		s.start(target, memory)
+	}
+
+	for key, r := range s.running {
+		if !seen[key] {
+			r.stop()
+			delete(s.running, key)
+			monitor.Forget(r.myConf.KubernetesNamespace, r.myConf.KubernetesDeploymentName, unusedQueues(r.myConf, targets))
+			status.forget(key)
+		}
+	}
+}
+
+// unusedQueues returns the names of the queues of removed that none of
+// targets read, whose metrics can be dropped.
+func unusedQueues(removed conf.MyConfType, targets []conf.MyConfType) []string {
+	used := map[string]bool{}
+	for _, target := range targets {
+		for _, url := range target.QueueUrls() {
+			used[sqs.QueueName(url)] = true
+		}
+	}
+	var unused []string
+	for _, url := range removed.QueueUrls() {
+		if name := sqs.QueueName(url); !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	return unused
+}
+
+// start starts the polling loop of target. The target is tracked for the
+// health checks even if its clients cannot be created, so it is reported as
+// never polling rather than silently not scaled. Without state-configmap the
+// cool off state is kept in memory, which carries it over from a loop the
+// target was restarted from.
+func (s *supervisor) start(target conf.MyConfType, memory *state.MemoryStore) {
+	log.Info("Starting kube-sqs-autoscaler for deployment " + target.KubernetesDeploymentName + " and namespace " + target.KubernetesNamespace)
+	log.Infof("Config = %+v ", target)
+	r := &runningTarget{
+		myConf:  target,
+		updates: make(chan conf.MyConfType, 1),
+		failed:  true,
+		memory:  memory,
+	}
+	s.running[targetKey(target)] = r
+	status.track(targetKey(target), target.PollInterval)
+
+	p, err := scale.NewPodAutoScaler(target)
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": target.KubernetesDeploymentName, "error": err}).Errorf("Failed to create autoscaler, not starting polling loop")
+		return
+	}
+	src, err := metric.New(target)
+	if err != nil {
+		log.WithFields(log.Fields{"kubernetesDeploymentName": target.KubernetesDeploymentName, "source": target.Source, "error": err}).Errorf("Failed to create source, not starting polling loop")
+		return
+	}
+
+	var store state.Store = memory
+	if target.StateConfigMap != "" {
+		client, err := scale.NewKubeClient(target)
+		if err != nil {
+			log.WithFields(log.Fields{"kubernetesDeploymentName": target.KubernetesDeploymentName, "error": err}).Errorf("Failed to create state store, not starting polling loop")
+			return
+		}
+		store = &state.ConfigMapStore{Client: client, Namespace: target.KubernetesNamespace, Name: target.StateConfigMap, Key: target.KubernetesDeploymentName}
+	}
+
+	r.failed = false
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		RunWithUpdates(p, src, target, r.updates, store)
+	}()
+}
+
+// watchConfig returns a channel that receives whenever the process gets a
+// SIGHUP or, if path is set, the contents of the config file change. The file
+// is polled rather than watched, as ConfigMap volumes are updated by swapping
+// a symlink.
+func watchConfig(path string, period time.Duration) <-chan struct{} {
+	reload := make(chan struct{})
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		last, _ := ioutil.ReadFile(path)
+		var tick <-chan time.Time
+		if path != "" {
+			ticker := time.NewTicker(period)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP")
+			case <-tick:
+				contents, err := ioutil.ReadFile(path)
+				if err != nil {
+					log.WithFields(log.Fields{"config": path, "error": err}).Errorf("Failed to read config file")
+					continue
+				}
+				if bytes.Equal(contents, last) {
+					continue
+				}
+				last = contents
+				log.WithFields(log.Fields{"config": path}).Info("Config file changed")
+			}
+			reload <- struct{}{}
+		}
+	}()
+	return reload
+}